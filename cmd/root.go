@@ -1,10 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 
+	"github.com/acrlabs/kompile/pkg/controller"
 	"github.com/acrlabs/kompile/pkg/kompiler"
 )
 
@@ -14,6 +17,15 @@ type options struct {
 	filename       string
 	outputDir      string
 	dockerRegistry string
+	strict         bool
+	runtime        string
+	warmPods       int
+	idleTimeout    time.Duration
+	startTimeout   time.Duration
+	maxReplicas    int
+	backoffLimit   int
+	jobTTL         time.Duration
+	jobDeadline    time.Duration
 }
 
 func rootCmd() *cobra.Command {
@@ -29,7 +41,7 @@ func rootCmd() *cobra.Command {
 		},
 	}
 
-	root.PersistentFlags().StringVarP(&opts.filename, "filename", "f", "", "go program to parse")
+	root.PersistentFlags().StringVarP(&opts.filename, "filename", "f", "", "go file or package directory to compile")
 	root.PersistentFlags().StringVarP(&opts.outputDir, "output", "o", "output", "directory to create generated files")
 	root.PersistentFlags().StringVarP(
 		&opts.dockerRegistry,
@@ -38,6 +50,61 @@ func rootCmd() *cobra.Command {
 		"localhost:5000",
 		"location of docker registry to push to",
 	)
+	root.PersistentFlags().BoolVar(
+		&opts.strict,
+		"strict",
+		false,
+		"fail compilation if any goroutine can't be offloaded",
+	)
+	root.PersistentFlags().StringVar(
+		&opts.runtime,
+		"runtime",
+		string(controller.PodRuntime),
+		"how to run offloaded functions: \"pod\" (a pod per call), \"deployment\" (a Deployment per function), "+
+			"\"job\" (a Job per call) or \"local\" (a subprocess per call, without a cluster)",
+	)
+	root.PersistentFlags().IntVar(
+		&opts.warmPods,
+		"warm-pods",
+		0,
+		"number of idle pods to keep ready for each service (0 starts a new pod for every call)",
+	)
+	root.PersistentFlags().DurationVar(
+		&opts.idleTimeout,
+		"idle-timeout",
+		5*time.Minute,
+		"how long an idle pod beyond --warm-pods can sit idle before it's deleted",
+	)
+	root.PersistentFlags().DurationVar(
+		&opts.startTimeout,
+		"start-timeout",
+		2*time.Minute,
+		"how long to wait for a new pod to be ready before the call fails",
+	)
+	root.PersistentFlags().IntVar(
+		&opts.maxReplicas,
+		"max-replicas",
+		0,
+		"with --runtime=deployment, autoscale each function up to this many replicas (0 disables autoscaling)",
+	)
+	root.PersistentFlags().IntVar(
+		&opts.backoffLimit,
+		"backoff-limit",
+		3,
+		"with --runtime=job, how many times to retry a call whose pod fails",
+	)
+	root.PersistentFlags().DurationVar(
+		&opts.jobTTL,
+		"job-ttl",
+		10*time.Minute,
+		"with --runtime=job, how long to keep a finished job before it's deleted",
+	)
+	root.PersistentFlags().DurationVar(
+		&opts.jobDeadline,
+		"job-deadline",
+		time.Hour,
+		"with --runtime=job, how long a job can run for before it's stopped",
+	)
 	if err := root.MarkPersistentFlagRequired("filename"); err != nil {
 		panic(err)
 	}
@@ -46,11 +113,32 @@ func rootCmd() *cobra.Command {
 }
 
 func start(opts *options) {
-	k, err := kompiler.New(opts.filename)
+	k, err := kompiler.New(opts.filename, opts.strict)
 	if err != nil {
 		panic(err)
 	}
-	if err := k.Compile(opts.outputDir, opts.dockerRegistry); err != nil {
+	runtime := controller.Runtime(opts.runtime)
+	switch runtime {
+	case controller.PodRuntime, controller.DeploymentRuntime, controller.JobRuntime, controller.LocalRuntime:
+	default:
+		panic(fmt.Sprintf("unknown runtime %q", opts.runtime))
+	}
+
+	compileOpts := kompiler.Options{
+		Runtime: runtime,
+		Pool: controller.PoolConfig{
+			WarmPods:     opts.warmPods,
+			IdleTimeout:  opts.idleTimeout,
+			StartTimeout: opts.startTimeout,
+		},
+		Job: controller.JobConfig{
+			BackoffLimit: opts.backoffLimit,
+			TTL:          opts.jobTTL,
+			Deadline:     opts.jobDeadline,
+		},
+		MaxReplicas: opts.maxReplicas,
+	}
+	if err := k.Compile(opts.outputDir, opts.dockerRegistry, &compileOpts); err != nil {
 		panic(err)
 	}
 }
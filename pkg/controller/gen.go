@@ -3,11 +3,15 @@ package controller
 import (
 	"fmt"
 	"go/ast"
-	"go/printer"
+	"go/format"
 	"go/token"
+	"go/types"
 	"html/template"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/samber/lo"
 	"golang.org/x/tools/go/ast/astutil"
@@ -23,119 +27,274 @@ var controllerYamlTemplate string
 type ControllerConfig struct {
 	ControllerName  string
 	ControllerImage string
+	Pool            PoolConfig
+	Job             JobConfig
 }
 
-func GenerateServiceCall(funcName, dockerRegistry string, callArg ast.Expr) ast.Stmt {
-	lowerName := strings.ToLower(funcName)
-	dockerImageStr := fmt.Sprintf("\"%s/%s:latest\"", dockerRegistry, lowerName)
+// PoolConfig controls how many warm pods the controller keeps ready for each service, how long any extra idle pods are
+// kept before they're deleted, and how long a new pod has to become ready; it's passed to the controller through its
+// environment (see komputil.WarmPodsEnv)
+type PoolConfig struct {
+	WarmPods     int
+	IdleTimeout  time.Duration
+	StartTimeout time.Duration
+}
+
+// JobConfig controls how many times a Job retries an invocation whose pod fails, how long a finished Job is kept around
+// before it's deleted, and how long a Job can run for; like PoolConfig, it's passed to the controller through its
+// environment (see komputil.JobBackoffLimitEnv)
+type JobConfig struct {
+	BackoffLimit int
+	TTL          time.Duration
+	Deadline     time.Duration
+}
+
+// Runtime is how the services for offloaded functions are run
+type Runtime string
+
+const (
+	// PodRuntime starts a pod for each invocation (or takes one from the pool of warm pods, see PoolConfig)
+	PodRuntime Runtime = "pod"
+
+	// DeploymentRuntime runs each service as a long-lived Deployment behind a Service, which invocations are sent to
+	DeploymentRuntime Runtime = "deployment"
+
+	// JobRuntime runs each invocation as a Job, which retries it if its pod fails (see JobConfig)
+	JobRuntime Runtime = "job"
+
+	// LocalRuntime runs each invocation's service as a subprocess of the controller, without a cluster
+	LocalRuntime Runtime = "local"
+)
+
+// Channel is a channel passed to an offloaded function; the service sends its values back through the callback called
+// Name, which are then passed along to Expr, the caller's channel.  Inbound channels go the other way: the controller
+// forwards the values from the caller's channel to the service.
+type Channel struct {
+	Name    string
+	Expr    ast.Expr
+	Inbound bool
+}
+
+// GenerateServiceCall builds the statements that replace a go statement in the controller: they register the
+// function's results and the caller's channels for this invocation, start the service and send it the arguments, and
+// then start forwarding any inbound channels to it.  A go statement can't fail, so if the service doesn't start, the
+// invocation fails instead (see komputil.RegisterChannel) and the caller carries on.  If ctx isn't nil, it's the
+// caller's context, which can cancel the invocation, and pod is the configuration for the service's pods.  It also
+// returns the packages that those statements refer to.
+func GenerateServiceCall(
+	funcName, dockerRegistry string,
+	pod *util.PodConfig,
+	ctx ast.Expr,
+	args []ast.Expr,
+	channels []Channel,
+) (ast.Stmt, []util.Import) {
+	imports := []util.Import{{Path: util.KomputilPackage}}
+	if ctx == nil {
+		ctx = &ast.CallExpr{Fun: &ast.Ident{Name: "context.Background"}}
+		imports = append(imports, util.Import{Path: "context"})
+	}
+
 	stmts := []ast.Stmt{
 		&ast.AssignStmt{
-			Lhs: []ast.Expr{
-				&ast.Ident{Name: "podUrl"},
-				&ast.Ident{Name: "err"},
-			},
+			Lhs: []ast.Expr{&ast.Ident{Name: "invocationID"}},
 			Tok: token.DEFINE,
-			Rhs: []ast.Expr{
-				&ast.CallExpr{
-					Fun: &ast.Ident{Name: "komputil.CreateAndWaitForPod"},
-					Args: []ast.Expr{
-						&ast.BasicLit{Value: fmt.Sprintf("\"%s\"", lowerName), Kind: token.STRING},
-						&ast.BasicLit{Value: dockerImageStr, Kind: token.STRING},
-					},
+			Rhs: []ast.Expr{&ast.CallExpr{Fun: &ast.Ident{Name: "komputil.NewInvocationID"}}},
+		},
+		&ast.ExprStmt{
+			X: &ast.CallExpr{
+				Fun: &ast.Ident{Name: "komputil.RegisterResult"},
+				Args: []ast.Expr{
+					&ast.Ident{Name: "invocationID"},
+					&ast.BasicLit{Value: fmt.Sprintf("%q", funcName), Kind: token.STRING},
 				},
 			},
 		},
-		&ast.IfStmt{
-			Cond: &ast.BinaryExpr{
-				X:  &ast.Ident{Name: "err"},
-				Op: token.NEQ,
-				Y:  &ast.Ident{Name: "nil"},
+	}
+	for _, ch := range lo.Filter(channels, func(ch Channel, _ int) bool { return !ch.Inbound }) {
+		stmts = append(stmts, &ast.ExprStmt{
+			X: &ast.CallExpr{
+				Fun: &ast.Ident{Name: "komputil.RegisterChannel"},
+				Args: []ast.Expr{
+					&ast.Ident{Name: "invocationID"},
+					&ast.BasicLit{Value: fmt.Sprintf("%q", ch.Name), Kind: token.STRING},
+					ch.Expr,
+				},
 			},
-			Body: &ast.BlockStmt{
-				List: []ast.Stmt{
-					&ast.ExprStmt{X: util.HttpErrorExpr("could not create pod: %v")},
-					&ast.ReturnStmt{},
+		})
+	}
+
+	// The service is ready to receive values once it's accepted the request
+	forwards := []ast.Stmt{}
+	for _, ch := range lo.Filter(channels, func(ch Channel, _ int) bool { return ch.Inbound }) {
+		name := &ast.BasicLit{Value: fmt.Sprintf("%q", ch.Name), Kind: token.STRING}
+		forwards = append(forwards, &ast.ExprStmt{
+			X: &ast.CallExpr{
+				Fun: &ast.Ident{Name: "komputil.RegisterForwarder"},
+				Args: []ast.Expr{
+					&ast.Ident{Name: "invocationID"},
+					name,
+					&ast.CallExpr{
+						Fun: &ast.Ident{Name: "komputil.Forward"},
+						Args: []ast.Expr{
+							&ast.CallExpr{
+								Fun: &ast.Ident{Name: "komputil.NewCallback"},
+								Args: []ast.Expr{
+									&ast.Ident{Name: "podUrl"},
+									&ast.Ident{Name: "invocationID"},
+									name,
+								},
+							},
+							ch.Expr,
+						},
+					},
 				},
 			},
-		},
-		&ast.ExprStmt{
-			X: util.FmtPrintExpr("Printf", "making request to pod: %s\\n", "podUrl"),
-		},
-		&ast.AssignStmt{
-			Lhs: []ast.Expr{&ast.Ident{Name: "reader"}},
+		})
+	}
+
+	invoke := &ast.IfStmt{
+		Init: &ast.AssignStmt{
+			Lhs: []ast.Expr{
+				&ast.Ident{Name: lo.Ternary(len(forwards) > 0, "podUrl", "_")},
+				&ast.Ident{Name: "err"},
+			},
 			Tok: token.DEFINE,
 			Rhs: []ast.Expr{&ast.CallExpr{
-				Fun:  &ast.Ident{Name: "bytes.NewReader"},
-				Args: []ast.Expr{callArg},
+				Fun: &ast.Ident{Name: "komputil.Invoke"},
+				Args: append([]ast.Expr{
+					ctx,
+					&ast.Ident{Name: "invocationID"},
+					PodConfigLit(funcName, dockerRegistry, pod),
+				}, args...),
 			}},
 		},
-		&ast.AssignStmt{
-			Lhs: []ast.Expr{&ast.Ident{Name: "_"}, &ast.Ident{Name: "err"}},
-			Tok: token.ASSIGN,
-			Rhs: []ast.Expr{&ast.CallExpr{
-				Fun: &ast.Ident{Name: "http.Post"},
-				Args: []ast.Expr{
-					&ast.Ident{Name: "podUrl"},
-					&ast.BasicLit{Value: "\"application/octet-stream\"", Kind: token.STRING},
-					&ast.Ident{Name: "reader"},
-				},
-			}},
+		Cond: &ast.BinaryExpr{
+			X:  &ast.Ident{Name: "err"},
+			Op: token.NEQ,
+			Y:  &ast.Ident{Name: "nil"},
 		},
-		&ast.IfStmt{
-			Cond: &ast.BinaryExpr{
-				X:  &ast.Ident{Name: "err"},
-				Op: token.NEQ,
-				Y:  &ast.Ident{Name: "nil"},
-			},
-			Body: &ast.BlockStmt{
-				List: []ast.Stmt{
-					&ast.ExprStmt{X: util.HttpErrorExpr("could not make POST request to service: %v")},
-					&ast.ReturnStmt{},
+		Body: &ast.BlockStmt{
+			List: []ast.Stmt{
+				&ast.ExprStmt{
+					X: &ast.CallExpr{
+						Fun:  &ast.Ident{Name: "komputil.Fail"},
+						Args: []ast.Expr{&ast.Ident{Name: "invocationID"}, &ast.Ident{Name: "err"}},
+					},
 				},
 			},
 		},
 	}
+	if len(forwards) > 0 {
+		invoke.Else = &ast.BlockStmt{List: forwards}
+	}
+	stmts = append(stmts, invoke)
 
-	return &ast.BlockStmt{List: stmts}
+	return &ast.BlockStmt{List: stmts}, imports
 }
 
-func GenerateMain(rootNode ast.Node, services, endpoints []string, outputDir string, fset *token.FileSet) error {
-	stripServiceFunctions(rootNode, services)
-	addCallbackEndpoints(rootNode, endpoints)
-	addChannelGlobals(rootNode, endpoints)
-	addHandlerFuncs(rootNode, endpoints)
-
-	// Create the output file
-	controllerOutputDir := fmt.Sprintf("%s/%s", outputDir, util.ControllerDir)
-	os.RemoveAll(controllerOutputDir)
-	if err := os.MkdirAll(controllerOutputDir, os.ModePerm); err != nil {
-		return fmt.Errorf("could not create output directory: %w", err)
+// PodConfigLit builds the komputil.PodConfig that the controller starts the pods for funcName's service with
+func PodConfigLit(funcName, dockerRegistry string, pod *util.PodConfig) ast.Expr {
+	image := fmt.Sprintf("%s/%s:latest", dockerRegistry, strings.ToLower(funcName))
+	volumes := lo.Map(pod.Volumes, func(volume util.Volume, _ int) ast.Expr {
+		return &ast.CompositeLit{Elts: []ast.Expr{
+			keyValue("HostPath", stringLit(volume.HostPath)),
+			keyValue("MountPath", stringLit(volume.MountPath)),
+		}}
+	})
+
+	elts := []ast.Expr{
+		keyValue("Name", stringLit(util.ResourceName(funcName))),
+		keyValue("Service", stringLit(funcName)),
+		keyValue("Image", stringLit(image)),
 	}
-	outfile := fmt.Sprintf("%s/%s", controllerOutputDir, util.MainGoFile)
-	file, err := os.Create(outfile)
-	if err != nil {
-		return fmt.Errorf("could not create file: %w", err)
+	if len(pod.Resources) > 0 {
+		elts = append(elts, keyValue("Resources", stringMapLit(pod.Resources)))
+	}
+	if len(volumes) > 0 {
+		elts = append(elts, keyValue("Volumes", &ast.CompositeLit{
+			Type: &ast.ArrayType{Elt: &ast.Ident{Name: "komputil.Volume"}},
+			Elts: volumes,
+		}))
+	}
+	if len(pod.NodeSelector) > 0 {
+		elts = append(elts, keyValue("NodeSelector", stringMapLit(pod.NodeSelector)))
 	}
-	defer file.Close()
 
-	if err := printer.Fprint(file, fset, rootNode); err != nil {
-		return fmt.Errorf("could not write to file: %w", err)
+	return &ast.UnaryExpr{
+		Op: token.AND,
+		X:  &ast.CompositeLit{Type: &ast.Ident{Name: "komputil.PodConfig"}, Elts: elts},
+	}
+}
+
+func keyValue(key string, value ast.Expr) ast.Expr {
+	return &ast.KeyValueExpr{Key: &ast.Ident{Name: key}, Value: value}
+}
+
+func stringLit(s string) ast.Expr {
+	return &ast.BasicLit{Value: fmt.Sprintf("%q", s), Kind: token.STRING}
+}
+
+// stringMapLit builds a map[string]string literal, with its keys in order so that the output is stable
+func stringMapLit(m map[string]string) ast.Expr {
+	keys := lo.Keys(m)
+	slices.Sort(keys)
+	return &ast.CompositeLit{
+		Type: &ast.MapType{Key: &ast.Ident{Name: "string"}, Value: &ast.Ident{Name: "string"}},
+		Elts: lo.Map(keys, func(key string, _ int) ast.Expr {
+			return &ast.KeyValueExpr{Key: stringLit(key), Value: stringLit(m[key])}
+		}),
+	}
+}
+
+// GenerateMain writes out the rewritten files for the controller's main package; imports are the packages referred to
+// by the code that's already been added to each file, and info is the type information for the original files.  If
+// callbacks is set, the controller also needs to listen for values and results sent back by the offloaded functions,
+// which run on the given runtime; on the pod runtime, the controller starts the warm pods for each of the services in
+// configs (see PodConfigLit) when it starts.
+func GenerateMain(
+	files []*ast.File,
+	imports map[*ast.File][]util.Import,
+	serviceFuncs []*ast.FuncDecl,
+	callbacks bool,
+	runtime Runtime,
+	configs []ast.Expr,
+	mainDir string,
+	fset *token.FileSet,
+	info *types.Info,
+) error {
+	mainFile, ok := lo.Find(files, hasMainFunc)
+	if !ok {
+		return fmt.Errorf("could not find main function")
 	}
 
-	if err := util.GenerateImports(controllerOutputDir); err != nil {
-		return fmt.Errorf("could not generate imports: %w", err)
+	for _, file := range files {
+		stripServiceFunctions(file, serviceFuncs)
 	}
+	if callbacks {
+		addCallbackHandler(mainFile, runtime, configs)
+		imports[mainFile] = append(imports[mainFile], util.Import{Path: "net/http"},
+			util.Import{Path: util.KomputilPackage})
+	}
+
+	// Overwrite the copied source files for the main package with the rewritten ones
+	for _, file := range files {
+		util.RemoveUnusedImports(fset, file, info)
+		util.AddImports(fset, file, imports[file])
 
-	if err := util.InitGoMod("client", controllerOutputDir); err != nil {
-		return fmt.Errorf("could not set up go.mod: %w", err)
+		outfile := filepath.Join(mainDir, filepath.Base(fset.File(file.Pos()).Name()))
+		if err := writeFile(outfile, file, fset); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func WriteYaml(outputDir string) error {
+func WriteYaml(outputDir string, pool PoolConfig, job JobConfig) error {
 	config := ControllerConfig{
 		ControllerName:  util.ControllerName,
 		ControllerImage: fmt.Sprintf("localhost:5000/%s:latest", util.ControllerDir),
+		Pool:            pool,
+		Job:             job,
 	}
 	f, err := os.Create(fmt.Sprintf("%s/%s/deployment.yml", outputDir, util.ControllerDir))
 	if err != nil {
@@ -154,153 +313,89 @@ func WriteYaml(outputDir string) error {
 	return nil
 }
 
-func stripServiceFunctions(rootNode ast.Node, services []string) {
-	astutil.Apply(rootNode, nil, func(c *astutil.Cursor) bool {
-		n := c.Node()
-		if f, ok := n.(*ast.FuncDecl); ok {
-			if lo.Contains(services, f.Name.Name) {
-				c.Delete()
-			}
-		}
-		return true
+func writeFile(outfile string, file *ast.File, fset *token.FileSet) error {
+	f, err := os.Create(outfile)
+	if err != nil {
+		return fmt.Errorf("could not create file: %w", err)
+	}
+	defer f.Close()
+
+	if err := format.Node(f, fset, file); err != nil {
+		return fmt.Errorf("could not write to file: %w", err)
+	}
+	return nil
+}
+
+func hasMainFunc(file *ast.File) bool {
+	return lo.ContainsBy(file.Decls, func(decl ast.Decl) bool {
+		f, ok := decl.(*ast.FuncDecl)
+		return ok && f.Recv == nil && f.Name.Name == "main"
 	})
 }
 
-func addCallbackEndpoints(rootNode ast.Node, endpoints []string) {
+func stripServiceFunctions(rootNode ast.Node, serviceFuncs []*ast.FuncDecl) {
 	astutil.Apply(rootNode, nil, func(c *astutil.Cursor) bool {
 		n := c.Node()
 		if f, ok := n.(*ast.FuncDecl); ok {
-			if f.Name.Name == "main" {
-				stmts := lo.Map(endpoints, func(endpoint string, _ int) ast.Stmt {
-					return &ast.ExprStmt{
-						X: &ast.CallExpr{
-							Fun: &ast.Ident{Name: "http.HandleFunc"},
-							Args: []ast.Expr{
-								&ast.BasicLit{
-									Value: fmt.Sprintf("\"/%s\"", endpoint),
-									Kind:  token.STRING,
-								},
-								&ast.Ident{Name: endpoint},
-							},
-						},
-					}
-				})
-				f.Body.List = append(stmts, f.Body.List...)
+			if lo.Contains(serviceFuncs, f) {
+				c.Delete()
 			}
 		}
 		return true
 	})
 }
 
-func addChannelGlobals(rootNode ast.Node, endpoints []string) {
-	file, ok := rootNode.(*ast.File)
-	if !ok {
-		panic("root node is not a file")
-	}
-	channelDecls := lo.Map(endpoints, func(endpoint string, _ int) ast.Decl {
-		return &ast.GenDecl{
-			Tok: token.VAR,
-			Specs: []ast.Spec{
-				&ast.ValueSpec{
-					Names: []*ast.Ident{{Name: fmt.Sprintf("%s_ch", endpoint)}},
-					Values: []ast.Expr{
-						&ast.CallExpr{
-							Fun: &ast.Ident{Name: "make"},
-							Args: []ast.Expr{
-								&ast.ChanType{
-									Dir:   3,
-									Value: &ast.Ident{Name: "string"},
-								},
-							},
-						},
+// addCallbackHandler registers the handler that routes values and results sent back from the services, after setting
+// up the runtime (and, on a cluster, cleaning up anything left behind by an earlier run of the controller, and then
+// starting the warm pods); it has to be set up before anything else happens in main, since main might not return until
+// the program exits
+func addCallbackHandler(file *ast.File, runtime Runtime, configs []ast.Expr) {
+	for _, decl := range file.Decls {
+		if f, ok := decl.(*ast.FuncDecl); ok && f.Recv == nil && f.Name.Name == "main" {
+			setup := []ast.Stmt{&ast.ExprStmt{
+				X: &ast.CallExpr{
+					Fun:  &ast.Ident{Name: "komputil.UseRuntime"},
+					Args: []ast.Expr{runtimeExpr(runtime)},
+				},
+			}}
+			if runtime != LocalRuntime {
+				setup = append(setup, &ast.ExprStmt{
+					X: &ast.CallExpr{Fun: &ast.Ident{Name: "komputil.CleanUpStale"}},
+				})
+			}
+			if runtime == PodRuntime {
+				for _, config := range configs {
+					setup = append(setup, &ast.ExprStmt{
+						X: &ast.CallExpr{Fun: &ast.Ident{Name: "komputil.WarmUp"}, Args: []ast.Expr{config}},
+					})
+				}
+			}
+			handler := &ast.ExprStmt{
+				X: &ast.CallExpr{
+					Fun: &ast.Ident{Name: "http.HandleFunc"},
+					Args: []ast.Expr{
+						&ast.Ident{Name: "komputil.CallbackPath"},
+						&ast.Ident{Name: "komputil.HandleCallback"},
 					},
 				},
-			},
+			}
+			f.Body.List = append(append(setup, handler), f.Body.List...)
 		}
-	})
-	file.Decls = append(file.Decls, channelDecls...)
+	}
 }
 
-func addHandlerFuncs(rootNode ast.Node, endpoints []string) {
-	file, ok := rootNode.(*ast.File)
-	if !ok {
-		panic("root node is not a file")
+// runtimeExpr builds the komputil.Runtime that the controller runs the services on
+func runtimeExpr(runtime Runtime) ast.Expr {
+	var name string
+	switch runtime {
+	case LocalRuntime:
+		return &ast.CallExpr{Fun: &ast.Ident{Name: "komputil.NewLocalRuntime"}}
+	case DeploymentRuntime:
+		name = "komputil.DeploymentRuntime"
+	case JobRuntime:
+		name = "komputil.JobRuntime"
+	default:
+		name = "komputil.PodRuntime"
 	}
-	handlerFuncDecls := lo.Map(endpoints, func(endpoint string, _ int) ast.Decl {
-		return &ast.FuncDecl{
-			Name: &ast.Ident{Name: endpoint},
-			Type: &ast.FuncType{
-				Params: &ast.FieldList{
-					List: []*ast.Field{
-						{
-							Names: []*ast.Ident{{Name: "w"}},
-							Type:  &ast.Ident{Name: "http.ResponseWriter"},
-						},
-						{
-							Names: []*ast.Ident{{Name: "r"}},
-							Type:  &ast.Ident{Name: "*http.Request"},
-						},
-					},
-				},
-			},
-			Body: &ast.BlockStmt{
-				List: []ast.Stmt{
-					&ast.ExprStmt{
-						X: util.FmtPrintExpr("Println", fmt.Sprintf("received response on handler %s", endpoint)),
-					},
-					&ast.AssignStmt{
-						Lhs: []ast.Expr{
-							&ast.Ident{Name: "b"},
-							&ast.Ident{Name: "err"},
-						},
-						Tok: token.DEFINE,
-						Rhs: []ast.Expr{
-							&ast.CallExpr{
-								Fun: &ast.Ident{Name: "io.ReadAll"},
-								Args: []ast.Expr{
-									&ast.Ident{Name: "r.Body"},
-								},
-							},
-						},
-					},
-					&ast.IfStmt{
-						Cond: &ast.BinaryExpr{
-							X:  &ast.Ident{Name: "err"},
-							Op: token.NEQ,
-							Y:  &ast.Ident{Name: "nil"},
-						},
-						Body: &ast.BlockStmt{
-							List: []ast.Stmt{
-								&ast.ExprStmt{X: util.HttpErrorExpr("could not read response: %v")},
-								&ast.ReturnStmt{},
-							},
-						},
-					},
-					&ast.SendStmt{
-						Chan: &ast.Ident{Name: fmt.Sprintf("%s_ch", endpoint)},
-						Value: &ast.CallExpr{
-							Fun: &ast.Ident{Name: "string"},
-							Args: []ast.Expr{
-								&ast.Ident{Name: "b"},
-							},
-						},
-					},
-					&ast.ExprStmt{
-						X: &ast.CallExpr{
-							Fun: &ast.Ident{Name: "r.Body.Close"},
-						},
-					},
-					&ast.ExprStmt{
-						X: &ast.CallExpr{
-							Fun: &ast.Ident{Name: "w.WriteHeader"},
-							Args: []ast.Expr{
-								&ast.Ident{Name: "http.StatusOK"},
-							},
-						},
-					},
-				},
-			},
-		}
-	})
-	file.Decls = append(file.Decls, handlerFuncDecls...)
+	return &ast.UnaryExpr{Op: token.AND, X: &ast.CompositeLit{Type: &ast.Ident{Name: name}}}
 }
@@ -14,11 +14,18 @@ import (
 //go:embed embeds/Dockerfile
 var dockerfile string
 
+type buildTarget struct {
+	name string
+	pkg  string
+}
+
+// goBuilder builds the executables, and if docker is set, their images as well
 type goBuilder struct {
-	goEnv []string
+	goEnv  []string
+	docker bool
 }
 
-func newGoBuilder() (*goBuilder, error) {
+func newGoBuilder(docker bool) (*goBuilder, error) {
 	home := os.Getenv("HOME")
 	goEnv := []string{
 		"CGO_ENABLED=0",
@@ -26,16 +33,18 @@ func newGoBuilder() (*goBuilder, error) {
 		fmt.Sprintf("HOME=%s", home),
 	}
 	return &goBuilder{
-		goEnv: goEnv,
+		goEnv:  goEnv,
+		docker: docker,
 	}, nil
 }
 
-func (self *goBuilder) build(outputDir, dockerRegistry string, names []string) error {
-	for _, name := range names {
+func (self *goBuilder) build(outputDir, dockerRegistry string, targets []buildTarget) error {
+	for _, target := range targets {
+		name := target.name
 		workingDir := fmt.Sprintf("%s/%s", outputDir, name)
 
 		//nolint:gosec // this is fine dot jpeg
-		buildCmd := exec.Command("go", "build", "-trimpath", "-o", util.ExeFile, util.MainGoFile)
+		buildCmd := exec.Command("go", "build", "-trimpath", "-o", util.ExeFile, target.pkg)
 		buildCmd.Dir = workingDir
 		buildCmd.Env = self.goEnv
 		buildCmd.Stderr = os.Stderr
@@ -44,6 +53,9 @@ func (self *goBuilder) build(outputDir, dockerRegistry string, names []string) e
 		if err := buildCmd.Run(); err != nil {
 			return fmt.Errorf("could not run go build for %s: %w", name, err)
 		}
+		if !self.docker {
+			continue
+		}
 
 		f, err := os.Create(fmt.Sprintf("%s/Dockerfile", workingDir))
 		if err != nil {
@@ -0,0 +1,242 @@
+package kompiler
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+
+	"github.com/samber/lo"
+)
+
+// checkCaptures makes sure that a closure doesn't write to any of the variables it captures, or to anything inside
+// them (c.N = 5, arr[0] = 1, or p.N = 5 for a captured pointer p); the service only ever gets a copy of them, so the
+// caller would never see the writes
+func checkCaptures(lit *ast.FuncLit, captures []*types.Var, info *types.Info) error {
+	var err error
+	isCapture := func(expr ast.Expr) (*types.Var, bool) {
+		ident, _ := rootIdent(expr, info)
+		if ident == nil {
+			return nil, false
+		}
+		v, ok := info.Uses[ident].(*types.Var)
+		return v, ok && lo.Contains(captures, v)
+	}
+
+	ast.Inspect(lit.Body, func(n ast.Node) bool {
+		var lhs []ast.Expr
+		switch x := n.(type) {
+		case *ast.AssignStmt:
+			lhs = x.Lhs
+		case *ast.IncDecStmt:
+			lhs = []ast.Expr{x.X}
+		case *ast.UnaryExpr:
+			if x.Op == token.AND {
+				lhs = []ast.Expr{x.X}
+			}
+		}
+
+		for _, expr := range lhs {
+			if v, ok := isCapture(expr); ok && err == nil {
+				err = fmt.Errorf("shared memory: closure writes to captured variable %s", v.Name())
+			}
+		}
+		return err == nil
+	})
+	return err
+}
+
+// checkLocalTypes makes sure that an offloaded function only uses types that are declared at package level; a type
+// that's declared inside another function (e.g. a struct type declared in main and used by a closure) can't be copied
+// into the service, so it would be undefined there
+func checkLocalTypes(target *offloadTarget, info *types.Info) error {
+	if tn := localType(target.sig); tn != nil {
+		return fmt.Errorf("type %s is declared inside a function", tn.Name())
+	}
+
+	var err error
+	body := target.decl.Body
+	ast.Inspect(body, func(n ast.Node) bool {
+		// Types that are declared inside the offloaded function itself come along with it
+		if ident, ok := n.(*ast.Ident); ok {
+			tn, ok := info.Uses[ident].(*types.TypeName)
+			inside := ok && tn.Pos() >= body.Pos() && tn.Pos() < body.End()
+			if ok && !inside && localType(tn.Type()) != nil {
+				err = fmt.Errorf("type %s is declared inside a function", tn.Name())
+			}
+		}
+		return err == nil
+	})
+	return err
+}
+
+// localType returns the first type that typ is built from which is declared inside a function, or nil if there isn't
+// one; the underlying types of named types aren't followed, since a package-level type can't refer to a local one
+func localType(typ types.Type) *types.TypeName {
+	switch t := typ.(type) {
+	case *types.Named:
+		if obj := t.Obj(); obj.Pkg() != nil && obj.Parent() != obj.Pkg().Scope() {
+			return obj
+		}
+		for i := range t.TypeArgs().Len() {
+			if tn := localType(t.TypeArgs().At(i)); tn != nil {
+				return tn
+			}
+		}
+	case *types.Pointer:
+		return localType(t.Elem())
+	case *types.Slice:
+		return localType(t.Elem())
+	case *types.Array:
+		return localType(t.Elem())
+	case *types.Chan:
+		return localType(t.Elem())
+	case *types.Map:
+		if tn := localType(t.Key()); tn != nil {
+			return tn
+		}
+		return localType(t.Elem())
+	case *types.Struct:
+		for i := range t.NumFields() {
+			if tn := localType(t.Field(i).Type()); tn != nil {
+				return tn
+			}
+		}
+	case *types.Signature:
+		if tn := localType(t.Params()); tn != nil {
+			return tn
+		}
+		return localType(t.Results())
+	case *types.Tuple:
+		for i := range t.Len() {
+			if tn := localType(t.At(i).Type()); tn != nil {
+				return tn
+			}
+		}
+	}
+	return nil
+}
+
+// checkSerializable makes sure that a value of the given type can be JSON-encoded by the controller and decoded again
+// by the service without losing anything along the way
+func checkSerializable(typ types.Type) error {
+	return checkSerializableRec(typ, map[types.Type]bool{})
+}
+
+func checkSerializableRec(typ types.Type, seen map[types.Type]bool) error {
+	if seen[typ] {
+		return nil
+	}
+	seen[typ] = true
+
+	if named, ok := typ.(*types.Named); ok {
+		if isSyncType(named) {
+			return fmt.Errorf("mutex use: %s can't be shared with another process", named)
+		}
+
+		// Anything that knows how to marshal itself is fine
+		if hasMethod(typ, "MarshalJSON") && hasMethod(typ, "UnmarshalJSON") {
+			return nil
+		}
+	}
+
+	switch t := typ.Underlying().(type) {
+	case *types.Basic:
+		if t.Info()&(types.IsComplex|types.IsUntyped) != 0 || t.Kind() == types.UnsafePointer {
+			return fmt.Errorf("unsupported argument type: %s can't be serialized", typ)
+		}
+	case *types.Pointer:
+		return checkSerializableRec(t.Elem(), seen)
+	case *types.Slice:
+		return checkSerializableRec(t.Elem(), seen)
+	case *types.Array:
+		return checkSerializableRec(t.Elem(), seen)
+	case *types.Map:
+		if err := checkMapKey(t.Key()); err != nil {
+			return err
+		}
+		return checkSerializableRec(t.Elem(), seen)
+	case *types.Struct:
+		for i := range t.NumFields() {
+			field := t.Field(i)
+			if err := checkSerializableRec(field.Type(), seen); err != nil {
+				return err
+			}
+			if !field.Exported() {
+				return fmt.Errorf("unsupported argument type: %s has unexported field %s", typ, field.Name())
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported argument type: %s can't be serialized", typ)
+	}
+
+	return nil
+}
+
+// checkMapKey makes sure that a map with keys of the given type can be JSON-encoded; object keys are always strings in
+// JSON, so the keys have to be strings or integers, or know how to turn themselves into text and back
+func checkMapKey(typ types.Type) error {
+	if hasMethod(typ, "MarshalText") && hasMethod(typ, "UnmarshalText") {
+		return nil
+	}
+	if basic, ok := typ.Underlying().(*types.Basic); ok && basic.Info()&(types.IsString|types.IsInteger) != 0 {
+		return nil
+	}
+	return fmt.Errorf("unsupported argument type: map key %s can't be serialized", typ)
+}
+
+func hasMethod(typ types.Type, name string) bool {
+	obj, _, _ := types.LookupFieldOrMethod(types.NewPointer(typ), true, nil, name)
+	_, ok := obj.(*types.Func)
+	return ok
+}
+
+// containsSync returns true if a value of the given type holds one of the primitives from sync or sync/atomic,
+// either directly or through a pointer, field, etc.
+func containsSync(typ types.Type) bool {
+	return containsSyncRec(typ, map[types.Type]bool{})
+}
+
+func containsSyncRec(typ types.Type, seen map[types.Type]bool) bool {
+	if seen[typ] {
+		return false
+	}
+	seen[typ] = true
+
+	if named, ok := typ.(*types.Named); ok && isSyncType(named) {
+		return true
+	}
+
+	switch t := typ.Underlying().(type) {
+	case *types.Pointer:
+		return containsSyncRec(t.Elem(), seen)
+	case *types.Slice:
+		return containsSyncRec(t.Elem(), seen)
+	case *types.Array:
+		return containsSyncRec(t.Elem(), seen)
+	case *types.Map:
+		return containsSyncRec(t.Key(), seen) || containsSyncRec(t.Elem(), seen)
+	case *types.Struct:
+		for i := range t.NumFields() {
+			if containsSyncRec(t.Field(i).Type(), seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isContext returns true if typ is context.Context
+func isContext(typ types.Type) bool {
+	named, ok := typ.(*types.Named)
+	if !ok {
+		return false
+	}
+	pkg := named.Obj().Pkg()
+	return pkg != nil && pkg.Path() == "context" && named.Obj().Name() == "Context"
+}
+
+func isSyncType(named *types.Named) bool {
+	pkg := named.Obj().Pkg()
+	return pkg != nil && (pkg.Path() == "sync" || pkg.Path() == "sync/atomic")
+}
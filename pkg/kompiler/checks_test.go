@@ -0,0 +1,247 @@
+package kompiler
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strings"
+	"testing"
+)
+
+// typeCheck parses and type-checks src, which is a single file in package p
+func typeCheck(t *testing.T, src string) (*ast.File, *types.Package, *types.Info) {
+	t.Helper()
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "p.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := &types.Info{
+		Types:      map[ast.Expr]types.TypeAndValue{},
+		Defs:       map[*ast.Ident]types.Object{},
+		Uses:       map[*ast.Ident]types.Object{},
+		Selections: map[*ast.SelectorExpr]*types.Selection{},
+	}
+	config := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	pkg, err := config.Check("p", fset, []*ast.File{file}, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file, pkg, info
+}
+
+const serializableSrc = `package p
+
+import (
+	"sync"
+	"time"
+)
+
+type Plain struct {
+	A int
+	B []string
+	C map[string]float64
+	D *Plain
+}
+
+type Hidden struct {
+	a int
+}
+
+type Locked struct {
+	Mu sync.Mutex
+	N  int
+}
+
+type Custom struct {
+	hidden int
+}
+
+func (Custom) MarshalJSON() ([]byte, error) { return nil, nil }
+func (*Custom) UnmarshalJSON([]byte) error  { return nil }
+
+type MarshalOnly struct {
+	hidden int
+}
+
+func (MarshalOnly) MarshalJSON() ([]byte, error) { return nil, nil }
+
+type Wrapper struct {
+	Inner Hidden
+}
+
+type Key struct {
+	A, B int
+}
+
+type Name string
+
+var (
+	vInt         int
+	vString      string
+	vPlain       Plain
+	vPtr         *Plain
+	vArray       [2]Plain
+	vTime        time.Time
+	vCustom      Custom
+	vHidden      Hidden
+	vLocked      Locked
+	vMutex       *sync.RWMutex
+	vMarshalOnly MarshalOnly
+	vWrapper     Wrapper
+	vMap         map[string]Plain
+	vIntKey      map[int64]Plain
+	vNamedKey    map[Name]int
+	vTimeKey     map[time.Time]int
+	vStructKey   map[Key]int
+	vBoolKey     map[bool]Plain
+	vFloatKey    map[float64]int
+	vComplexKey  map[complex64]int
+	vFunc        func()
+	vChan        chan int
+	vComplex     complex128
+	vAny         any
+)
+`
+
+func TestCheckSerializable(t *testing.T) {
+	_, pkg, _ := typeCheck(t, serializableSrc)
+	for name, err := range map[string]string{
+		"vInt":         "",
+		"vString":      "",
+		"vPlain":       "",
+		"vPtr":         "",
+		"vArray":       "",
+		"vTime":        "",
+		"vCustom":      "",
+		"vHidden":      "has unexported field a",
+		"vLocked":      "mutex use",
+		"vMutex":       "mutex use",
+		"vMarshalOnly": "has unexported field hidden",
+		"vWrapper":     "has unexported field a",
+		"vMap":         "",
+		"vIntKey":      "",
+		"vNamedKey":    "",
+		"vTimeKey":     "",
+		"vStructKey":   "map key p.Key can't be serialized",
+		"vBoolKey":     "map key bool can't be serialized",
+		"vFloatKey":    "map key float64 can't be serialized",
+		"vComplexKey":  "map key complex64 can't be serialized",
+		"vFunc":        "can't be serialized",
+		"vChan":        "can't be serialized",
+		"vComplex":     "can't be serialized",
+		"vAny":         "can't be serialized",
+	} {
+		t.Run(name, func(t *testing.T) {
+			actual := checkSerializable(pkg.Scope().Lookup(name).Type())
+			if err == "" && actual != nil {
+				t.Errorf("unexpected error: %v", actual)
+			} else if err != "" && (actual == nil || !strings.Contains(actual.Error(), err)) {
+				t.Errorf("expected error containing %q, got %v", err, actual)
+			}
+		})
+	}
+}
+
+const capturesSrc = `package p
+
+type Counter struct {
+	N   int
+	Arr [3]int
+}
+
+func f() {
+	n := 0
+	c := Counter{}
+	p := &Counter{}
+	arr := [3]int{}
+	s := []int{1}
+
+	_ = func() { println(n, c.N, p.N, arr[0], s[0]) }
+	_ = func() { n = 1 }
+	_ = func() { n++ }
+	_ = func() { c.N = 5 }
+	_ = func() { c.Arr[1] = 5 }
+	_ = func() { p.N = 5 }
+	_ = func() { arr[0] = 1 }
+	_ = func() { s[0] = 1 }
+	_ = func() { _ = &c.N }
+	_ = func() { x := c; x.N = 1 }
+	_ = func() { n := 1; n++ }
+}
+`
+
+func TestCheckCaptures(t *testing.T) {
+	file, _, info := typeCheck(t, capturesSrc)
+	expected := []string{"", "n", "n", "c", "c", "p", "arr", "s", "c", "", ""}
+
+	lits := []*ast.FuncLit{}
+	ast.Inspect(file, func(n ast.Node) bool {
+		if lit, ok := n.(*ast.FuncLit); ok {
+			lits = append(lits, lit)
+			return false
+		}
+		return true
+	})
+	if len(lits) != len(expected) {
+		t.Fatalf("expected %d closures, got %d", len(expected), len(lits))
+	}
+
+	for i, lit := range lits {
+		err := checkCaptures(lit, freeVars(lit, info), info)
+		if expected[i] == "" && err != nil {
+			t.Errorf("closure %d: unexpected error: %v", i, err)
+		} else if expected[i] != "" && (err == nil || !strings.HasSuffix(err.Error(), "captured variable "+expected[i])) {
+			t.Errorf("closure %d: expected write to %s, got %v", i, expected[i], err)
+		}
+	}
+}
+
+const localTypesSrc = `package main
+
+import "fmt"
+
+type Point struct{ X, Y int }
+
+func draw(p Point) { fmt.Println(p) }
+
+func main() {
+	type point struct{ X, Y int }
+	p := point{1, 2}
+	ps := []point{p}
+
+	go draw(Point{})
+	go func() { fmt.Println(p.X) }()
+	go func() { fmt.Println(len(ps)) }()
+	go func() { fmt.Println(point{}) }()
+	go func(n int) { fmt.Println(n) }(p.X)
+	go func() {
+		type inner struct{ N int }
+		fmt.Println(inner{1})
+	}()
+}
+`
+
+func TestCheckLocalTypes(t *testing.T) {
+	self := loadModule(t, map[string]string{"main.go": localTypesSrc})
+	expected := []string{
+		"",
+		"type point is declared inside a function",
+		"type point is declared inside a function",
+		"type point is declared inside a function",
+		"",
+		"",
+	}
+
+	if len(self.diagnostics) != len(expected) {
+		t.Fatalf("expected %d goroutines, got %d", len(expected), len(self.diagnostics))
+	}
+	for i, diag := range self.diagnostics {
+		if diag.Reason != expected[i] {
+			t.Errorf("%s: expected %q, got %q", diag.Pos, expected[i], diag.Reason)
+		}
+	}
+}
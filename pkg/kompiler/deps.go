@@ -0,0 +1,126 @@
+package kompiler
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"slices"
+	"strings"
+
+	"github.com/samber/lo"
+
+	"github.com/acrlabs/kompile/pkg/util"
+)
+
+// dependencies finds every package-level declaration that an offloaded function needs in order to compile on its own:
+// the functions it calls, the types it uses (along with all of their methods), and the variables and constants it
+// references, followed transitively through each of those declarations in turn.  Any of the package's init functions
+// might set its variables, so they're collected too as soon as we need a variable.  Only declarations from the same
+// package as the offloaded function are collected; anything from another package is imported by the service instead,
+// so we also return every package that the collected declarations refer to.
+func (self *Kompiler) dependencies(target *offloadTarget) ([]ast.Decl, []util.Import) {
+	pkg := self.mainPkg
+	if target.fn != nil {
+		pkg = self.pkgsByTypes[target.fn.Pkg()]
+	}
+	info := pkg.TypesInfo
+
+	seen := map[ast.Decl]bool{target.decl: true}
+	queue := []ast.Decl{target.decl}
+	deps := []ast.Decl{}
+	imports := map[string]util.Import{}
+	addImport := func(imported *types.Package, name string) {
+		imp := util.Import{Path: imported.Path()}
+		if imported.Name() != name {
+			imp.Name = name
+		}
+		imports[imp.Path] = imp
+	}
+
+	add := func(decl ast.Decl) {
+		if !seen[decl] {
+			seen[decl] = true
+			queue = append(queue, decl)
+			deps = append(deps, decl)
+		}
+	}
+	enqueue := func(obj types.Object) {
+		if obj == nil || obj.Pkg() != pkg.Types || obj.Parent() != pkg.Types.Scope() {
+			return
+		}
+		lo.ForEach(self.declsFor(obj), func(decl ast.Decl, _ int) { add(decl) })
+		if _, ok := obj.(*types.Var); ok {
+			lo.ForEach(self.inits[pkg.Types], func(decl *ast.FuncDecl, _ int) { add(decl) })
+		}
+	}
+
+	// The capture parameters of a lifted closure were built from their types rather than parsed from the source, so
+	// they don't show up in info.Uses and we have to look them up by name
+	for _, v := range target.captures {
+		for _, imp := range typeImports(v.Type(), pkg.Types) {
+			imports[imp.Path] = imp
+		}
+	}
+	for _, field := range target.decl.Type.Params.List[:len(target.captures)] {
+		ast.Inspect(field.Type, func(n ast.Node) bool {
+			switch x := n.(type) {
+			case *ast.SelectorExpr:
+				return false
+			case *ast.Ident:
+				enqueue(pkg.Types.Scope().Lookup(x.Name))
+			}
+			return true
+		})
+	}
+
+	for len(queue) > 0 {
+		decl := queue[0]
+		queue = queue[1:]
+		ast.Inspect(decl, func(n ast.Node) bool {
+			ident, ok := n.(*ast.Ident)
+			if !ok {
+				return true
+			}
+			if pkgName, ok := info.Uses[ident].(*types.PkgName); ok {
+				addImport(pkgName.Imported(), pkgName.Name())
+			} else {
+				enqueue(info.Uses[ident])
+			}
+			return true
+		})
+	}
+
+	slices.SortFunc(deps, func(a, b ast.Decl) int { return int(declPos(a) - declPos(b)) })
+	specs := lo.Values(imports)
+	slices.SortFunc(specs, func(a, b util.Import) int { return strings.Compare(a.Path, b.Path) })
+	return deps, specs
+}
+
+func (self *Kompiler) declsFor(obj types.Object) []ast.Decl {
+	switch x := obj.(type) {
+	case *types.Func:
+		if decl, ok := self.functions[x]; ok {
+			return []ast.Decl{decl}
+		}
+	case *types.TypeName:
+		decls := []ast.Decl{}
+		if decl, ok := self.typeDecls[x]; ok {
+			decls = append(decls, decl)
+		}
+		return append(decls, lo.Map(self.methods[x], func(m *ast.FuncDecl, _ int) ast.Decl { return m })...)
+	case *types.Var, *types.Const:
+		if decl, ok := self.valueDecls[x]; ok {
+			return []ast.Decl{decl}
+		}
+	}
+	return nil
+}
+
+// declPos returns the position of a declaration in the original source; the declarations we build for individual
+// type and var specs don't have a position of their own, so we use the position of the spec instead
+func declPos(decl ast.Decl) token.Pos {
+	if gen, ok := decl.(*ast.GenDecl); ok && gen.TokPos == token.NoPos && len(gen.Specs) > 0 {
+		return gen.Specs[0].Pos()
+	}
+	return decl.Pos()
+}
@@ -0,0 +1,175 @@
+package kompiler
+
+import (
+	"go/ast"
+	"go/types"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/samber/lo"
+
+	"github.com/acrlabs/kompile/pkg/util"
+)
+
+// loadModule writes files (along with a go.mod for example.com/m) to a new directory, and finds all of the goroutines
+// in its main package
+func loadModule(t *testing.T, files map[string]string) *Kompiler {
+	t.Helper()
+	dir := t.TempDir()
+	files["go.mod"] = "module example.com/m\n\ngo 1.22\n"
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	self, err := New(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	self.findImportantNodes()
+	self.findGoroutines()
+	return self
+}
+
+// declName names a declaration for comparison: the function name (with its receiver type, for methods), or the names
+// in each of its specs
+func declName(decl ast.Decl) string {
+	switch x := decl.(type) {
+	case *ast.FuncDecl:
+		if x.Recv != nil {
+			return types.ExprString(x.Recv.List[0].Type) + "." + x.Name.Name
+		}
+		return x.Name.Name
+	case *ast.GenDecl:
+		names := []string{}
+		for _, spec := range x.Specs {
+			switch s := spec.(type) {
+			case *ast.TypeSpec:
+				names = append(names, s.Name.Name)
+			case *ast.ValueSpec:
+				names = append(names, lo.Map(s.Names, func(n *ast.Ident, _ int) string { return n.Name })...)
+			}
+		}
+		return strings.Join(names, ",")
+	}
+	return ""
+}
+
+const depsLib = `package lib
+
+import (
+	"strings"
+	"unicode"
+)
+
+var table map[string]int
+
+func init() {
+	table = map[string]int{"a": 1}
+}
+
+type Counter struct{ N int }
+
+func (c *Counter) Add(n int) { c.N += n }
+
+func (c Counter) String() string { return strings.Repeat("x", c.N) }
+
+func Work(n int) int { return n + table["a"] + helper() }
+
+func helper() int { return 4 }
+
+func Count(s string) int {
+	c := Counter{}
+	for _, r := range s {
+		if unicode.IsUpper(r) {
+			c.Add(1)
+		}
+	}
+	return c.N
+}
+
+func unused() {}
+`
+
+const depsMain = `package main
+
+import (
+	"fmt"
+
+	"example.com/m/lib"
+)
+
+const (
+	small = iota
+	big
+)
+
+var limit = big * 10
+
+type point struct{ X, Y int }
+
+func init() { limit++ }
+
+func process(p point) { fmt.Println(p.X + limit) }
+
+func pure(n int) { fmt.Println(n) }
+
+func main() {
+	go lib.Work(1)
+	go lib.Count("Ab")
+	go process(point{})
+	go pure(1)
+}
+`
+
+func TestDependencies(t *testing.T) {
+	self := loadModule(t, map[string]string{"main.go": depsMain, "lib/lib.go": depsLib})
+	targets := lo.SliceToMap(lo.Values(self.targets), func(target *offloadTarget) (string, *offloadTarget) {
+		return target.name, target
+	})
+
+	for name, tc := range map[string]struct {
+		decls   []string
+		imports []util.Import
+	}{
+		"libWork": {
+			decls:   []string{"table", "init", "helper"},
+			imports: []util.Import{},
+		},
+		"libCount": {
+			decls:   []string{"Counter", "*Counter.Add", "Counter.String"},
+			imports: []util.Import{{Path: "strings"}, {Path: "unicode"}},
+		},
+		"process": {
+			decls:   []string{"small,big", "limit", "point", "init"},
+			imports: []util.Import{{Path: "fmt"}},
+		},
+		"pure": {
+			decls:   []string{},
+			imports: []util.Import{{Path: "fmt"}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			target, ok := targets[name]
+			if !ok {
+				t.Fatalf("%s was not offloaded", name)
+			}
+
+			decls := lo.Map(target.decls, func(decl ast.Decl, _ int) string { return declName(decl) })
+			if !reflect.DeepEqual(decls, tc.decls) {
+				t.Errorf("expected declarations %v, got %v", tc.decls, decls)
+			}
+			if !reflect.DeepEqual(target.imports, tc.imports) {
+				t.Errorf("expected imports %v, got %v", tc.imports, target.imports)
+			}
+		})
+	}
+}
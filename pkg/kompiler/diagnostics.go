@@ -0,0 +1,90 @@
+package kompiler
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+
+	"github.com/samber/lo"
+)
+
+// Diagnostic records what the kompiler did with a single go statement: either it was offloaded into its own
+// service, or it was left in place for the reason given
+type Diagnostic struct {
+	Pos       token.Position
+	Service   string
+	Offloaded bool
+	Reason    string
+	Warnings  []string
+}
+
+func (self Diagnostic) String() string {
+	if !self.Offloaded {
+		return fmt.Sprintf("%s: goroutine not offloaded: %s", self.Pos, self.Reason)
+	}
+
+	msg := fmt.Sprintf("%s: goroutine offloaded to service %s", self.Pos, self.Service)
+	for _, w := range self.Warnings {
+		msg += fmt.Sprintf("\n    warning: %s", w)
+	}
+	return msg
+}
+
+// findGoroutines walks every go statement in the module and decides whether it can be offloaded; the ones that can
+// are saved (along with everything needed to generate their services) for replaceGoroutines to act on later
+func (self *Kompiler) findGoroutines() {
+	for _, pkg := range self.pkgs {
+		for _, file := range pkg.Syntax {
+			ast.Inspect(file, func(n ast.Node) bool {
+				goStmt, ok := n.(*ast.GoStmt)
+				if !ok {
+					return true
+				}
+
+				if pkg != self.mainPkg {
+					self.notOffloaded(goStmt, "only goroutines started from the main package can be offloaded")
+					return true
+				}
+
+				target, err := self.resolveTarget(file, goStmt)
+				if err != nil {
+					self.notOffloaded(goStmt, err.Error())
+					return true
+				}
+
+				self.targets[goStmt] = target
+				self.diagnostics = append(self.diagnostics, Diagnostic{
+					Pos:       self.fset.Position(goStmt.Pos()),
+					Service:   target.name,
+					Offloaded: true,
+					Warnings:  target.warnings,
+				})
+
+				// Anything inside an offloaded closure runs in the service, so we don't look any further
+				return false
+			})
+		}
+	}
+}
+
+func (self *Kompiler) notOffloaded(goStmt *ast.GoStmt, reason string) {
+	self.diagnostics = append(self.diagnostics, Diagnostic{
+		Pos:    self.fset.Position(goStmt.Pos()),
+		Reason: reason,
+	})
+}
+
+func (self *Kompiler) printDiagnostics() {
+	fmt.Println("goroutine report:")
+	for _, d := range self.diagnostics {
+		fmt.Printf("  %s\n", d)
+	}
+}
+
+func (self *Kompiler) checkDiagnostics() error {
+	failed := lo.CountBy(self.diagnostics, func(d Diagnostic) bool { return !d.Offloaded })
+	if self.strict && failed > 0 {
+		return fmt.Errorf("%d goroutine(s) could not be offloaded", failed)
+	}
+	return nil
+}
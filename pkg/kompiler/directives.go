@@ -0,0 +1,131 @@
+package kompiler
+
+import (
+	"fmt"
+	"go/ast"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/acrlabs/kompile/pkg/util"
+)
+
+const directivePrefix = "//kompile:"
+
+// parseDirectives builds the pod configuration for an offloaded function from the //kompile: directives in the given
+// comments, which are the doc comment on the function's declaration (or, for a closure, the comment above the go
+// statement).  The directives are:
+//
+//	//kompile:resources cpu=2 memory=1Gi         resource requests for the service's container
+//	//kompile:volume /host/path[:/mount/path]    mounts a directory from the node (may be repeated)
+//	//kompile:nodeSelector key=value ...         labels of the nodes that the service can run on
+//
+// Volumes and node selectors replace the defaults (see util.DefaultPodConfig) rather than adding to them.
+func parseDirectives(doc *ast.CommentGroup) (*util.PodConfig, error) {
+	config := util.DefaultPodConfig()
+	if doc == nil {
+		return config, nil
+	}
+
+	volumes := []util.Volume{}
+	var nodeSelector map[string]string
+	for _, comment := range doc.List {
+		directive, ok := strings.CutPrefix(comment.Text, directivePrefix)
+		if !ok {
+			continue
+		}
+
+		name, args, _ := strings.Cut(directive, " ")
+		fields := strings.Fields(args)
+		switch name {
+		case "resources":
+			pairs, err := parsePairs(fields)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %sresources directive: %w", directivePrefix, err)
+			}
+			for key, value := range pairs {
+				if _, err := resource.ParseQuantity(value); err != nil {
+					return nil, fmt.Errorf("invalid %sresources directive: %s: %w", directivePrefix, key, err)
+				}
+				config.Resources[key] = value
+			}
+		case "volume":
+			volume, err := parseVolume(fields)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %svolume directive: %w", directivePrefix, err)
+			}
+			volumes = append(volumes, volume)
+		case "nodeSelector":
+			pairs, err := parsePairs(fields)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %snodeSelector directive: %w", directivePrefix, err)
+			}
+			if nodeSelector == nil {
+				nodeSelector = map[string]string{}
+			}
+			for key, value := range pairs {
+				nodeSelector[key] = value
+			}
+		default:
+			return nil, fmt.Errorf("unknown directive %s%s", directivePrefix, name)
+		}
+	}
+
+	if len(volumes) > 0 {
+		config.Volumes = volumes
+	}
+	if nodeSelector != nil {
+		config.NodeSelector = nodeSelector
+	}
+	return config, nil
+}
+
+// directiveComments returns the comments that hold the directives for target: the doc comment on its declaration, or
+// for a closure (which doesn't have one), the comment directly above the go statement
+func (self *Kompiler) directiveComments(file *ast.File, goStmt *ast.GoStmt, target *offloadTarget) *ast.CommentGroup {
+	if target.fn != nil {
+		return target.decl.Doc
+	}
+
+	line := self.fset.Position(goStmt.Pos()).Line
+	for _, group := range file.Comments {
+		if self.fset.Position(group.End()).Line == line-1 {
+			return group
+		}
+	}
+	return nil
+}
+
+// parsePairs parses key=value arguments
+func parsePairs(fields []string) (map[string]string, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("expected key=value pairs")
+	}
+
+	pairs := map[string]string{}
+	for _, field := range fields {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || key == "" || value == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", field)
+		}
+		pairs[key] = value
+	}
+	return pairs, nil
+}
+
+// parseVolume parses a host path, optionally followed by where to mount it in the container (which is the same path
+// by default)
+func parseVolume(fields []string) (util.Volume, error) {
+	if len(fields) != 1 {
+		return util.Volume{}, fmt.Errorf("expected /host/path[:/mount/path]")
+	}
+
+	hostPath, mountPath, ok := strings.Cut(fields[0], ":")
+	if !ok {
+		mountPath = hostPath
+	}
+	if !strings.HasPrefix(hostPath, "/") || !strings.HasPrefix(mountPath, "/") {
+		return util.Volume{}, fmt.Errorf("volume paths must be absolute, got %q", fields[0])
+	}
+	return util.Volume{HostPath: hostPath, MountPath: mountPath}, nil
+}
@@ -0,0 +1,170 @@
+package kompiler
+
+import (
+	"go/ast"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/acrlabs/kompile/pkg/util"
+)
+
+func commentGroup(lines ...string) *ast.CommentGroup {
+	group := &ast.CommentGroup{}
+	for _, line := range lines {
+		group.List = append(group.List, &ast.Comment{Text: line})
+	}
+	return group
+}
+
+func TestParseDirectives(t *testing.T) {
+	defaults := util.DefaultPodConfig()
+	for name, tc := range map[string]struct {
+		doc      *ast.CommentGroup
+		expected *util.PodConfig
+		err      string
+	}{
+		"no doc comment": {
+			doc:      nil,
+			expected: defaults,
+		},
+		"no directives": {
+			doc:      commentGroup("// process does some work", "//go:noinline"),
+			expected: defaults,
+		},
+		"resources": {
+			doc: commentGroup("//kompile:resources cpu=2 memory=1Gi"),
+			expected: &util.PodConfig{
+				Resources:    map[string]string{"cpu": "2", "memory": "1Gi"},
+				Volumes:      defaults.Volumes,
+				NodeSelector: defaults.NodeSelector,
+			},
+		},
+		"volumes replace the defaults": {
+			doc: commentGroup("//kompile:volume /scratch", "//kompile:volume /mnt/models:/models"),
+			expected: &util.PodConfig{
+				Resources: map[string]string{},
+				Volumes: []util.Volume{
+					{HostPath: "/scratch", MountPath: "/scratch"},
+					{HostPath: "/mnt/models", MountPath: "/models"},
+				},
+				NodeSelector: defaults.NodeSelector,
+			},
+		},
+		"node selectors are merged": {
+			doc: commentGroup("//kompile:nodeSelector gpu=true", "//kompile:nodeSelector zone=a zone=b"),
+			expected: &util.PodConfig{
+				Resources:    map[string]string{},
+				Volumes:      defaults.Volumes,
+				NodeSelector: map[string]string{"gpu": "true", "zone": "b"},
+			},
+		},
+		"invalid quantity": {
+			doc: commentGroup("//kompile:resources cpu=lots"),
+			err: "invalid //kompile:resources directive: cpu",
+		},
+		"invalid volume": {
+			doc: commentGroup("//kompile:volume data"),
+			err: "invalid //kompile:volume directive",
+		},
+		"missing node selector": {
+			doc: commentGroup("//kompile:nodeSelector"),
+			err: "invalid //kompile:nodeSelector directive",
+		},
+		"unknown directive": {
+			doc: commentGroup("//kompile:replicas 3"),
+			err: "unknown directive //kompile:replicas",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			config, err := parseDirectives(tc.doc)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error containing %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(config, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, config)
+			}
+		})
+	}
+}
+
+func TestParsePairs(t *testing.T) {
+	for name, tc := range map[string]struct {
+		fields   []string
+		expected map[string]string
+		ok       bool
+	}{
+		"single pair":     {fields: []string{"cpu=2"}, expected: map[string]string{"cpu": "2"}, ok: true},
+		"several pairs":   {fields: []string{"a=1", "b=2"}, expected: map[string]string{"a": "1", "b": "2"}, ok: true},
+		"value with =":    {fields: []string{"a=b=c"}, expected: map[string]string{"a": "b=c"}, ok: true},
+		"last one wins":   {fields: []string{"a=1", "a=2"}, expected: map[string]string{"a": "2"}, ok: true},
+		"no pairs":        {fields: nil},
+		"missing =":       {fields: []string{"cpu"}},
+		"missing key":     {fields: []string{"=2"}},
+		"missing value":   {fields: []string{"cpu="}},
+		"one bad of many": {fields: []string{"a=1", "b"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			pairs, err := parsePairs(tc.fields)
+			if !tc.ok {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", pairs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(pairs, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, pairs)
+			}
+		})
+	}
+}
+
+func TestParseVolume(t *testing.T) {
+	for name, tc := range map[string]struct {
+		fields   []string
+		expected util.Volume
+		ok       bool
+	}{
+		"host path only": {
+			fields:   []string{"/data"},
+			expected: util.Volume{HostPath: "/data", MountPath: "/data"},
+			ok:       true,
+		},
+		"host and mount path": {
+			fields:   []string{"/mnt/data:/data"},
+			expected: util.Volume{HostPath: "/mnt/data", MountPath: "/data"},
+			ok:       true,
+		},
+		"no paths":              {fields: nil},
+		"too many fields":       {fields: []string{"/a", "/b"}},
+		"relative host path":    {fields: []string{"data:/data"}},
+		"relative mount path":   {fields: []string{"/data:data"}},
+		"empty mount path":      {fields: []string{"/data:"}},
+		"relative path, no ':'": {fields: []string{"data"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			volume, err := parseVolume(tc.fields)
+			if !tc.ok {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", volume)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if volume != tc.expected {
+				t.Errorf("expected %+v, got %+v", tc.expected, volume)
+			}
+		})
+	}
+}
@@ -3,61 +3,206 @@ package kompiler
 import (
 	"fmt"
 	"go/ast"
-	"go/parser"
 	"go/token"
-	"log"
+	"go/types"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/samber/lo"
 	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
 
 	"github.com/acrlabs/kompile/pkg/controller"
 	"github.com/acrlabs/kompile/pkg/service"
 	"github.com/acrlabs/kompile/pkg/util"
 )
 
+// We type-check the whole module, which means we need types for all of its dependencies as well
+const loadMode = packages.NeedName |
+	packages.NeedFiles |
+	packages.NeedEmbedFiles |
+	packages.NeedModule |
+	packages.NeedImports |
+	packages.NeedDeps |
+	packages.NeedTypes |
+	packages.NeedTypesInfo |
+	packages.NeedSyntax
+
 type Kompiler struct {
-	node ast.Node
-	fset *token.FileSet
+	fset    *token.FileSet
+	module  *packages.Module
+	mainPkg *packages.Package
+	pkgs    []*packages.Package
+	strict  bool
+
+	// runtime is how the offloaded functions are going to be run, which limits what they can do
+	runtime controller.Runtime
+
+	// pkgsByTypes lets us find the syntax and type info for any package in the module from its type-checked package
+	pkgsByTypes map[*types.Package]*packages.Package
+
+	functions  map[*types.Func]*ast.FuncDecl
+	methods    map[*types.TypeName][]*ast.FuncDecl
+	typeDecls  map[*types.TypeName]*ast.GenDecl
+	valueDecls map[types.Object]*ast.GenDecl
+	inits      map[*types.Package][]*ast.FuncDecl
+	closures   map[string]int
 
-	functions map[string]*ast.FuncDecl
+	// serviceNames is the name of the service for each function that's offloaded, and takenNames holds the resource
+	// names that are already used by a service (or by the controller)
+	serviceNames map[any]string
+	takenNames   map[string]bool
+
+	targets     map[*ast.GoStmt]*offloadTarget
+	diagnostics []Diagnostic
 }
 
-func New(filename string) (*Kompiler, error) {
-	fset := token.NewFileSet()
+// New loads the package at path (and the rest of its module); in strict mode, compilation fails if any goroutine in
+// the module can't be offloaded
+func New(path string, strict bool) (*Kompiler, error) {
+	dir, err := packageDir(path)
+	if err != nil {
+		return nil, err
+	}
 
-	// parse the source file into an AST
-	node, err := parser.ParseFile(fset, filename, nil, parser.AllErrors)
+	// find out which package and module the target lives in
+	roots, err := packages.Load(&packages.Config{Mode: packages.NeedName | packages.NeedModule, Dir: dir}, ".")
 	if err != nil {
-		return nil, fmt.Errorf("error parsing file: %w", err)
+		return nil, fmt.Errorf("could not find package: %w", err)
 	}
+	if len(roots) != 1 || roots[0].Module == nil {
+		return nil, fmt.Errorf("%s is not part of a Go module", path)
+	}
+
+	// parse every package in the module into an AST
+	fset := token.NewFileSet()
+	pkgs, err := packages.Load(&packages.Config{Mode: loadMode, Dir: roots[0].Module.Dir, Fset: fset}, "./...")
+	if err != nil {
+		return nil, fmt.Errorf("error loading module: %w", err)
+	}
+	if packages.PrintErrors(pkgs) > 0 {
+		return nil, fmt.Errorf("errors loading module %s", roots[0].Module.Path)
+	}
+
+	mainPkg, ok := lo.Find(pkgs, func(pkg *packages.Package) bool { return pkg.PkgPath == roots[0].PkgPath })
+	if !ok {
+		return nil, fmt.Errorf("could not find package %s in module %s", roots[0].PkgPath, roots[0].Module.Path)
+	} else if mainPkg.Name != "main" {
+		return nil, fmt.Errorf("package %s is not a main package", mainPkg.PkgPath)
+	}
+
 	return &Kompiler{
-		node: node,
-		fset: fset,
+		fset:    fset,
+		module:  mainPkg.Module,
+		mainPkg: mainPkg,
+		pkgs:    pkgs,
+		strict:  strict,
+
+		pkgsByTypes: lo.SliceToMap(pkgs, func(pkg *packages.Package) (*types.Package, *packages.Package) {
+			return pkg.Types, pkg
+		}),
+
+		functions:  make(map[*types.Func]*ast.FuncDecl),
+		methods:    make(map[*types.TypeName][]*ast.FuncDecl),
+		typeDecls:  make(map[*types.TypeName]*ast.GenDecl),
+		valueDecls: make(map[types.Object]*ast.GenDecl),
+		inits:      make(map[*types.Package][]*ast.FuncDecl),
+		closures:   make(map[string]int),
 
-		functions: make(map[string]*ast.FuncDecl),
+		serviceNames: make(map[any]string),
+		takenNames:   map[string]bool{util.ResourceName(util.ControllerDir): true},
+
+		targets: make(map[*ast.GoStmt]*offloadTarget),
 	}, nil
 }
 
-func (self *Kompiler) Compile(outputDir, dockerRegistry string) error {
+// Options controls how the offloaded functions are run: Runtime picks between a pod per invocation (optionally from a
+// pool of warm pods), a long-lived Deployment per function, which is scaled up to MaxReplicas if that's set, a Job per
+// invocation, and a subprocess per invocation, for running without a cluster
+type Options struct {
+	Runtime     controller.Runtime
+	Pool        controller.PoolConfig
+	Job         controller.JobConfig
+	MaxReplicas int
+}
+
+func (self *Kompiler) Compile(outputDir, dockerRegistry string, opts *Options) error {
 	fmt.Println("finding potential service calls")
+	self.runtime = opts.Runtime
 	self.findImportantNodes()
-	services, endpoints := self.replaceGoroutines(outputDir, dockerRegistry)
-	if err := controller.GenerateMain(self.node, services, endpoints, outputDir, self.fset); err != nil {
+	self.findGoroutines()
+	self.printDiagnostics()
+	if err := self.checkDiagnostics(); err != nil {
+		return err
+	}
+
+	controllerOutputDir := fmt.Sprintf("%s/%s", outputDir, util.ControllerDir)
+	goMod, err := self.loadGoMod(controllerOutputDir)
+	if err != nil {
+		return err
+	}
+
+	// Services are generated from the original source, so this has to happen before we rewrite anything
+	services, err := self.generateServices(outputDir, goMod)
+	if err != nil {
+		return err
+	}
+	stripped, imports := self.replaceGoroutines(dockerRegistry)
+
+	if err := self.copyModule(controllerOutputDir, goMod); err != nil {
+		return fmt.Errorf("could not copy module: %w", err)
+	}
+
+	mainDir, err := filepath.Rel(self.module.Dir, filepath.Dir(self.mainPkg.GoFiles[0]))
+	if err != nil {
+		return fmt.Errorf("could not find main package directory: %w", err)
+	}
+	mainOutputDir := filepath.Join(controllerOutputDir, mainDir)
+	err = controller.GenerateMain(
+		self.mainPkg.Syntax,
+		imports,
+		stripped,
+		self.hasCallbacks(),
+		opts.Runtime,
+		lo.Map(self.serviceTargets(), func(target *offloadTarget, _ int) ast.Expr {
+			return controller.PodConfigLit(target.name, dockerRegistry, target.pod)
+		}),
+		mainOutputDir,
+		self.fset,
+		self.mainPkg.TypesInfo,
+	)
+	if err != nil {
 		return fmt.Errorf("could not generate client file: %w", err)
 	}
 
 	fmt.Println("building executables")
-	goBuilder, err := newGoBuilder()
+	goBuilder, err := newGoBuilder(opts.Runtime != controller.LocalRuntime)
 	if err != nil {
 		return fmt.Errorf("could not create builder: %w", err)
 	}
 
-	toBuild := append(services, util.ControllerDir)
+	toBuild := lo.Map(services, func(name string, _ int) buildTarget { return buildTarget{name: name, pkg: "."} })
+	toBuild = append(toBuild, buildTarget{name: util.ControllerDir, pkg: "./" + filepath.ToSlash(mainDir)})
 	if err := goBuilder.build(outputDir, dockerRegistry, toBuild); err != nil {
 		return fmt.Errorf("could not build executables: %w", err)
 	}
 
-	if err := controller.WriteYaml(outputDir); err != nil {
+	if opts.Runtime == controller.LocalRuntime {
+		// There's nothing to deploy
+		return nil
+	}
+	if opts.Runtime == controller.DeploymentRuntime {
+		for _, target := range self.serviceTargets() {
+			err := service.WriteYaml(target.name, outputDir, dockerRegistry, target.pod, opts.MaxReplicas)
+			if err != nil {
+				return fmt.Errorf("could not write YAML for service %s: %w", target.name, err)
+			}
+		}
+	}
+	if err := controller.WriteYaml(outputDir, opts.Pool, opts.Job); err != nil {
 		return fmt.Errorf("could not write controller YAML: %w", err)
 	}
 
@@ -65,92 +210,277 @@ func (self *Kompiler) Compile(outputDir, dockerRegistry string) error {
 }
 
 func (self *Kompiler) findImportantNodes() {
-	ast.Inspect(self.node, func(n ast.Node) bool {
-		if x, ok := n.(*ast.FuncDecl); ok {
-			self.functions[x.Name.Name] = x
+	for _, pkg := range self.pkgs {
+		for _, file := range pkg.Syntax {
+			for _, decl := range file.Decls {
+				switch x := decl.(type) {
+				case *ast.FuncDecl:
+					self.addFuncDecl(x, pkg.TypesInfo)
+				case *ast.GenDecl:
+					self.addGenDecl(x, pkg.TypesInfo)
+				}
+			}
 		}
-		return true
-	})
+	}
 }
 
-type nodeScanData struct {
-	node             ast.Node
-	chanReplacements map[string]string
+func (self *Kompiler) addFuncDecl(decl *ast.FuncDecl, info *types.Info) {
+	fn, ok := info.Defs[decl.Name].(*types.Func)
+	if !ok {
+		return
+	}
+	self.functions[fn] = decl
+	if decl.Recv == nil && decl.Name.Name == "init" {
+		self.inits[fn.Pkg()] = append(self.inits[fn.Pkg()], decl)
+	}
+
+	if recv := fn.Type().(*types.Signature).Recv(); recv != nil {
+		if named, ok := derefNamed(recv.Type()); ok {
+			self.methods[named.Obj()] = append(self.methods[named.Obj()], decl)
+		}
+	}
 }
 
-func (self *Kompiler) replaceGoroutines(outputDir, dockerRegistry string) ([]string, []string) {
-	services := []string{}
-	endpoints := []string{}
-	toScan := []nodeScanData{}
-
-	astutil.Apply(self.node, nil, func(c *astutil.Cursor) bool {
-		n := c.Node()
-		if goStmt, ok := n.(*ast.GoStmt); ok {
-			if callFun, ok := goStmt.Call.Fun.(*ast.Ident); ok {
-				if function, ok := self.functions[callFun.Name]; ok {
-					fmt.Printf("The goroutine is calling the function %s\n", function.Name.Name)
-
-					// These are the argument parameters inside the function declaration...
-					args, chanReplacements := selectNonChannelArgs(function, goStmt.Call.Args)
-
-					services = append(services, function.Name.Name)
-					endpoints = append(endpoints, lo.Values(chanReplacements)...)
-					toScan = append(toScan, nodeScanData{
-						node:             c.Parent(),
-						chanReplacements: chanReplacements,
-					})
-
-					fstring := service.PrintFullFuncDecl(function, args, self.fset)
-					if err := service.GenerateMain(function.Name.Name, fstring, outputDir); err != nil {
-						log.Fatalf("Error generating server file: %s", err)
-					}
-
-					stmt := controller.GenerateServiceCall(function.Name.Name, dockerRegistry, goStmt.Call.Args[0])
-					c.Replace(stmt)
+func (self *Kompiler) addGenDecl(decl *ast.GenDecl, info *types.Info) {
+	for _, spec := range decl.Specs {
+		switch x := spec.(type) {
+		case *ast.TypeSpec:
+			if tn, ok := info.Defs[x.Name].(*types.TypeName); ok {
+				self.typeDecls[tn] = typeDeclFor(x)
+			}
+		case *ast.ValueSpec:
+			// Constants can depend on their position in the group (via iota or implicit repetition), so we always
+			// keep the whole group together; variables can be split out individually
+			valueDecl := decl
+			if decl.Tok == token.VAR {
+				valueDecl = &ast.GenDecl{Tok: token.VAR, Specs: []ast.Spec{x}}
+			}
+			for _, name := range x.Names {
+				if obj := info.Defs[name]; obj != nil {
+					self.valueDecls[obj] = valueDecl
 				}
 			}
 		}
-		return true
-	})
+	}
+}
 
-	for _, nsd := range toScan {
-		astutil.Apply(nsd.node, nil, func(c *astutil.Cursor) bool {
-			n := c.Node()
-			if assStmt, ok := n.(*ast.AssignStmt); ok {
-				if lhsName, ok := assStmt.Lhs[0].(*ast.Ident); ok {
-					if _, ok := nsd.chanReplacements[lhsName.Name]; ok {
-						c.Delete()
-						return true
-					}
-				}
+// generateServices writes out a service for every function that gets offloaded; the same function may be offloaded
+// from several places, but we only need one service for it
+func (self *Kompiler) generateServices(outputDir string, goMod *util.GoMod) ([]string, error) {
+	services := []string{}
+	for _, target := range self.serviceTargets() {
+		args := target.params
+		services = append(services, target.name)
 
-				if rhsExpr, ok := assStmt.Rhs[0].(*ast.UnaryExpr); ok {
-					if rhsName, ok := rhsExpr.X.(*ast.Ident); ok {
-						if replacement, ok := nsd.chanReplacements[rhsName.Name]; ok {
-							rhsExpr.X = &ast.Ident{Name: fmt.Sprintf("%s_ch", replacement)}
-							return true
-						}
-					}
-					c.Replace(assStmt)
-				}
+		config := &service.ServerConfig{
+			FunctionDeclaration: service.PrintDecls(append(target.decls, target.decl), self.fset),
+			FunctionName:        target.name,
+			Module:              path.Join(self.module.Path, "kompile", target.name),
+			Imports:             target.imports,
+			Function:            target.decl.Name.Name,
+			Receiver:            target.recvType,
+			Params:              args.params,
+			Variadic:            target.sig.Variadic(),
+			Results:             args.results,
+		}
+		if err := service.GenerateMain(config, outputDir, goMod); err != nil {
+			return nil, fmt.Errorf("could not generate service %s: %w", target.name, err)
+		}
+	}
+
+	return services, nil
+}
+
+// serviceTargets returns one target for each service, in order of their names
+func (self *Kompiler) serviceTargets() []*offloadTarget {
+	targets := lo.UniqBy(lo.Values(self.targets), func(target *offloadTarget) any { return target.key })
+	slices.SortFunc(targets, func(a, b *offloadTarget) int { return strings.Compare(a.name, b.name) })
+	return targets
+}
+
+// replaceGoroutines swaps every offloaded go statement for a call to its service; it returns the functions that are no
+// longer needed by the controller, and the packages that the service calls refer to in each file
+func (self *Kompiler) replaceGoroutines(dockerRegistry string) ([]*ast.FuncDecl, map[*ast.File][]util.Import) {
+	offloaded := map[any]int{}
+	imports := map[*ast.File][]util.Import{}
+
+	for _, file := range self.mainPkg.Syntax {
+		astutil.Apply(file, nil, func(c *astutil.Cursor) bool {
+			goStmt, ok := c.Node().(*ast.GoStmt)
+			if !ok {
+				return true
 			}
+
+			target, ok := self.targets[goStmt]
+			if !ok {
+				return true
+			}
+			args := target.params
+			offloaded[target.key]++
+
+			stmt, stmtImports := controller.GenerateServiceCall(
+				target.name,
+				dockerRegistry,
+				target.pod,
+				args.context,
+				args.values,
+				args.channels,
+			)
+			imports[file] = append(imports[file], stmtImports...)
+			c.Replace(stmt)
 			return true
 		})
 	}
 
-	return services, endpoints
+	return self.unreferencedFunctions(offloaded), imports
 }
 
-func selectNonChannelArgs(funcDecl *ast.FuncDecl, callArgs []ast.Expr) ([]*ast.Field, map[string]string) {
-	chanReplacements := make(map[string]string)
-	args := lo.Filter(funcDecl.Type.Params.List, func(arg *ast.Field, i int) bool {
-		_, ok := arg.Type.(*ast.ChanType)
-		if ok {
-			callerChannelName := callArgs[i].(*ast.Ident).Name
-			chanReplacements[callerChannelName] = fmt.Sprintf("%s_%s", funcDecl.Name.Name, arg.Names[0].Name)
+// hasCallbacks returns true if anything gets offloaded; every offloaded function sends its results back to the
+// controller when it returns, along with the values sent on any of its channels
+func (self *Kompiler) hasCallbacks() bool {
+	return len(self.targets) > 0
+}
+
+// unreferencedFunctions returns the declarations of all the offloaded functions in the main package that are only
+// ever called from the (now-replaced) go statements; these can be safely removed from the controller, whereas
+// anything else that's still referenced needs to stay around.  Methods are always kept, since they may be needed to
+// satisfy an interface.
+func (self *Kompiler) unreferencedFunctions(offloaded map[any]int) []*ast.FuncDecl {
+	refs := map[types.Object]int{}
+	for _, obj := range self.mainPkg.TypesInfo.Uses {
+		refs[obj]++
+	}
+
+	return lo.FilterMap(lo.Keys(offloaded), func(key any, _ int) (*ast.FuncDecl, bool) {
+		fn, ok := key.(*types.Func)
+		if !ok || fn.Pkg() != self.mainPkg.Types || self.functions[fn].Recv != nil {
+			return nil, false
 		}
-		return !ok
+		return self.functions[fn], refs[fn] == offloaded[key]
 	})
+}
+
+// serviceArgs holds the parameters of an offloaded function as the generated service sees them, along with the values
+// the controller needs to send for them.  Channels can't be sent to another process, so for channel parameters the
+// service makes a channel of its own, and values are forwarded between it and the caller's channel via a callback.
+type serviceArgs struct {
+	params []service.Param
+
+	// values holds the receiver (if any) followed by every argument that isn't a channel or a context, all of which
+	// are sent to the service as JSON; channels are the caller's channels that the callbacks are routed to
+	values   []ast.Expr
+	channels []controller.Channel
+
+	// context is the caller's context, if the function takes one
+	context ast.Expr
+
+	// results says which of the function's results can be sent back to the controller when it returns
+	results []bool
+}
+
+func selectServiceArgs(target *offloadTarget, pkg *packages.Package) (*serviceArgs, error) {
+	args := &serviceArgs{}
+	if target.recv != nil {
+		args.values = append(args.values, target.recv)
+	}
+
+	var err error
+	for i := range target.sig.Params().Len() {
+		if paramErr := args.addParam(target, i, pkg); paramErr != nil && err == nil {
+			err = paramErr
+		}
+	}
+
+	return args, err
+}
+
+func (self *serviceArgs) addParam(target *offloadTarget, i int, pkg *packages.Package) error {
+	param := target.sig.Params().At(i)
+	arg := target.args[i]
 
-	return args, chanReplacements
+	// A context can't be sent anywhere, so the service passes in one of its own instead, which follows the caller's
+	if isContext(param.Type()) {
+		if self.context == nil {
+			self.context = arg
+		}
+		self.params = append(self.params, service.Param{
+			Type:    types.TypeString(param.Type(), qualifier(param.Pkg())),
+			Context: true,
+		})
+		return nil
+	}
+
+	if ch, ok := param.Type().Underlying().(*types.Chan); ok {
+		// The arguments for a closure's captured variables are made up by liftClosure, so the type checker has never
+		// seen them, but they're variables by definition
+		if i >= len(target.captures) {
+			ident, ok := ast.Unparen(arg).(*ast.Ident)
+			if !ok {
+				return fmt.Errorf("unsupported argument type: channel %s must be passed as a variable", types.ExprString(arg))
+			}
+			if _, ok := pkg.TypesInfo.ObjectOf(ident).(*types.Var); !ok {
+				return fmt.Errorf("unsupported argument type: channel %s must be passed as a variable", ident.Name)
+			}
+		}
+		if err := checkSerializable(ch.Elem()); err != nil {
+			return fmt.Errorf("channel %s: %w", param.Name(), err)
+		}
+
+		// The service makes its own channel for the function to use; values sent on it are forwarded back to us,
+		// unless the function can only receive from it, in which case we forward the caller's values to the service
+		serviceChan := types.NewChan(types.SendRecv, ch.Elem())
+		inbound := ch.Dir() == types.RecvOnly
+		self.params = append(self.params, service.Param{
+			Type:     types.TypeString(serviceChan, qualifier(param.Pkg())),
+			Callback: param.Name(),
+			Inbound:  inbound,
+		})
+		self.channels = append(self.channels, controller.Channel{Name: param.Name(), Expr: arg, Inbound: inbound})
+		return nil
+	}
+
+	if err := checkSerializable(param.Type()); err != nil {
+		return fmt.Errorf("argument %s: %w", param.Name(), err)
+	}
+
+	self.values = append(self.values, arg)
+	self.params = append(self.params, service.Param{Type: types.TypeString(param.Type(), qualifier(param.Pkg()))})
+	return nil
+}
+
+// selectResults decides which of the function's results get sent back to the controller; errors are always sent (as
+// their message), but anything else that can't be serialized is dropped, with a warning
+func (self *serviceArgs) selectResults(target *offloadTarget) []string {
+	warnings := []string{}
+	errorType := types.Universe.Lookup("error").Type()
+	for i := range target.sig.Results().Len() {
+		typ := target.sig.Results().At(i).Type()
+		var err error
+		if !types.AssignableTo(typ, errorType) {
+			err = checkSerializable(typ)
+		}
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("result %d won't be sent back to the controller: %v", i, err))
+		}
+		self.results = append(self.results, err == nil)
+	}
+	return warnings
+}
+
+// packageDir accepts either a Go source file or a package directory, and returns the directory of the package
+func packageDir(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("could not read %s: %w", path, err)
+	}
+
+	if !info.IsDir() {
+		path = filepath.Dir(path)
+	}
+
+	dir, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve %s: %w", path, err)
+	}
+	return dir, nil
 }
@@ -0,0 +1,85 @@
+package kompiler
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/acrlabs/kompile/pkg/util"
+)
+
+// loadGoMod collects the dependencies that the generated modules are built with: everything the source module
+// requires, plus everything the kompile runtime requires, plus local replacements for both modules themselves.
+// kompileDir is any one of the generated module directories, which is where the kompile replace is relative to.
+func (self *Kompiler) loadGoMod(kompileDir string) (*util.GoMod, error) {
+	goMod, err := util.LoadGoMod(self.module.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not load dependencies for %s: %w", self.module.Path, err)
+	}
+
+	kompileMod, err := util.LoadGoMod(filepath.Join(kompileDir, util.KompileDir))
+	if err != nil {
+		return nil, fmt.Errorf("could not load dependencies for %s: %w", util.KompileModule, err)
+	}
+	goMod.Merge(kompileMod)
+
+	goMod.AddLocal(self.module.Path, self.module.Dir)
+	goMod.AddLocal(util.KompileModule, util.KompileDir)
+	return goMod, nil
+}
+
+// copyModule copies every file belonging to one of the module's packages into outputDir, and writes out go.mod and
+// go.sum with our dependencies; the controller is built from this copy, so that everything the main package imports
+// from its own module is still there
+func (self *Kompiler) copyModule(outputDir string, goMod *util.GoMod) error {
+	os.RemoveAll(outputDir)
+
+	files := []string{}
+	for _, pkg := range self.pkgs {
+		files = append(files, pkg.GoFiles...)
+		files = append(files, pkg.OtherFiles...)
+		files = append(files, pkg.EmbedFiles...)
+		files = append(files, pkg.IgnoredFiles...)
+	}
+
+	for _, src := range files {
+		rel, err := filepath.Rel(self.module.Dir, src)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("file %s is outside of module %s", src, self.module.Path)
+		}
+
+		if err := copyFile(src, filepath.Join(outputDir, rel)); err != nil {
+			return fmt.Errorf("could not copy %s: %w", rel, err)
+		}
+	}
+
+	if err := goMod.Write(self.module.Path, outputDir); err != nil {
+		return fmt.Errorf("could not set up go.mod: %w", err)
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("could not open file: %w", err)
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return fmt.Errorf("could not create directory: %w", err)
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("could not create file: %w", err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("could not write file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package kompiler
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"path/filepath"
+
+	"github.com/samber/lo"
+	"golang.org/x/tools/go/types/typeutil"
+)
+
+// safetyChecker walks an offloaded function (and everything it calls inside the module) looking for state that it
+// shares with the rest of the program; once the function runs in its own pod, none of that state is shared anymore,
+// so the function would silently behave differently than it does locally.
+//
+// Writes to package-level variables and use of shared sync primitives make a function unsafe to offload; reads of
+// package-level variables and writes through pointer arguments are allowed, but generate a warning.
+type safetyChecker struct {
+	k      *Kompiler
+	params []*types.Var
+
+	visited  map[*ast.FuncDecl]bool
+	warnings []string
+	err      error
+}
+
+func (self *Kompiler) checkSafety(target *offloadTarget) ([]string, error) {
+	checker := &safetyChecker{
+		k:       self,
+		visited: map[*ast.FuncDecl]bool{},
+	}
+	if recv := target.sig.Recv(); recv != nil {
+		checker.params = append(checker.params, recv)
+	}
+	for i := range target.sig.Params().Len() {
+		checker.params = append(checker.params, target.sig.Params().At(i))
+	}
+
+	info := self.mainPkg.TypesInfo
+	if target.fn != nil {
+		info = self.pkgsByTypes[target.fn.Pkg()].TypesInfo
+		checker.visited[target.decl] = true
+	}
+	checker.check(target.decl.Body, info)
+
+	return lo.Uniq(checker.warnings), checker.err
+}
+
+func (self *safetyChecker) check(body *ast.BlockStmt, info *types.Info) {
+	ast.Inspect(body, func(n ast.Node) bool {
+		if self.err != nil {
+			return false
+		}
+
+		switch x := n.(type) {
+		case *ast.AssignStmt:
+			if x.Tok != token.DEFINE {
+				lo.ForEach(x.Lhs, func(lhs ast.Expr, _ int) { self.checkWrite(lhs, info) })
+			}
+		case *ast.IncDecStmt:
+			self.checkWrite(x.X, info)
+		case *ast.RangeStmt:
+			if x.Tok == token.ASSIGN {
+				lo.ForEach([]ast.Expr{x.Key, x.Value}, func(expr ast.Expr, _ int) { self.checkWrite(expr, info) })
+			}
+		case *ast.UnaryExpr:
+			// Taking the address of something means it can be written to from anywhere
+			if x.Op == token.AND {
+				self.checkWrite(x.X, info)
+			}
+		case *ast.Ident:
+			self.checkRead(x, info)
+		case *ast.CallExpr:
+			self.checkCallee(x, info)
+		}
+		return true
+	})
+}
+
+func (self *safetyChecker) checkWrite(expr ast.Expr, info *types.Info) {
+	if expr == nil {
+		return
+	}
+
+	root, indirect := rootIdent(expr, info)
+	if root == nil {
+		return
+	}
+
+	v, ok := info.Uses[root].(*types.Var)
+	if !ok {
+		return
+	}
+
+	if self.isGlobal(v) {
+		self.fail("shared memory: writes to package-level variable %s (at %s)", v.Name(), self.pos(root))
+	} else if indirect && lo.Contains(self.params, v) {
+		self.warn(
+			"writes through argument %s (at %s), but the change won't be visible to the caller",
+			v.Name(),
+			self.pos(root),
+		)
+	}
+}
+
+func (self *safetyChecker) checkRead(ident *ast.Ident, info *types.Info) {
+	v, ok := info.Uses[ident].(*types.Var)
+	if !ok || !self.isGlobal(v) {
+		return
+	}
+
+	if containsSync(v.Type()) {
+		self.fail(
+			"mutex use: package-level variable %s (at %s) can't be shared with another process",
+			v.Name(),
+			self.pos(ident),
+		)
+		return
+	}
+	self.warn(
+		"reads package-level variable %s (at %s); the service only sees its value once the package is initialized",
+		v.Name(),
+		self.pos(ident),
+	)
+}
+
+func (self *safetyChecker) checkCallee(call *ast.CallExpr, info *types.Info) {
+	fn := typeutil.StaticCallee(info, call)
+	if fn == nil {
+		return
+	}
+
+	fn = fn.Origin()
+	decl, ok := self.k.functions[fn]
+	if !ok || self.visited[decl] || decl.Body == nil {
+		return
+	}
+	self.visited[decl] = true
+	self.check(decl.Body, self.k.pkgsByTypes[fn.Pkg()].TypesInfo)
+}
+
+// isGlobal returns true for package-level variables that are declared in the module; anything declared outside of
+// the module (e.g., os.Args) is the same in every process, so we don't care about it
+func (self *safetyChecker) isGlobal(v *types.Var) bool {
+	if v.IsField() || v.Pkg() == nil || v.Parent() != v.Pkg().Scope() {
+		return false
+	}
+	_, ok := self.k.pkgsByTypes[v.Pkg()]
+	return ok
+}
+
+func (self *safetyChecker) pos(n ast.Node) string {
+	pos := self.k.fset.Position(n.Pos())
+	return fmt.Sprintf("%s:%d", filepath.Base(pos.Filename), pos.Line)
+}
+
+func (self *safetyChecker) warn(format string, args ...any) {
+	self.warnings = append(self.warnings, fmt.Sprintf(format, args...))
+}
+
+func (self *safetyChecker) fail(format string, args ...any) {
+	if self.err == nil {
+		self.err = fmt.Errorf(format, args...)
+	}
+}
+
+// rootIdent finds the variable that's ultimately being written to by an assignment to expr, and whether that write
+// happens indirectly (through a pointer, slice, or map), in which case the write is visible to anyone else holding
+// onto the same value
+func rootIdent(expr ast.Expr, info *types.Info) (*ast.Ident, bool) {
+	indirect := false
+	for {
+		switch x := expr.(type) {
+		case *ast.Ident:
+			return x, indirect
+		case *ast.ParenExpr:
+			expr = x.X
+		case *ast.StarExpr:
+			indirect = true
+			expr = x.X
+		case *ast.SelectorExpr:
+			// A qualified identifier (pkg.Var) refers directly to the variable in the other package
+			if ident, ok := x.X.(*ast.Ident); ok {
+				if _, ok := info.Uses[ident].(*types.PkgName); ok {
+					return x.Sel, indirect
+				}
+			}
+			if _, ok := underlying(info.TypeOf(x.X)).(*types.Pointer); ok {
+				indirect = true
+			}
+			expr = x.X
+		case *ast.IndexExpr:
+			switch underlying(info.TypeOf(x.X)).(type) {
+			case *types.Map, *types.Slice, *types.Pointer:
+				indirect = true
+			}
+			expr = x.X
+		default:
+			return nil, false
+		}
+	}
+}
+
+func underlying(typ types.Type) types.Type {
+	if typ == nil {
+		return nil
+	}
+	return typ.Underlying()
+}
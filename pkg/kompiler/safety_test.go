@@ -0,0 +1,108 @@
+package kompiler
+
+import (
+	"go/ast"
+	"go/types"
+	"testing"
+)
+
+const rootIdentSrc = `package p
+
+import "os"
+
+type T struct {
+	N   int
+	Arr [3]int
+	S   []int
+	P   *T
+}
+
+func f() {
+	var (
+		x   int
+		s   []int
+		m   map[string]int
+		arr [3]int
+		t   T
+		p   *T
+		pp  **T
+	)
+
+	x = 1
+	(x) = 1
+	s[0] = 1
+	m["a"] = 1
+	arr[0] = 1
+	t.N = 1
+	t.Arr[0] = 1
+	t.S[0] = 1
+	t.P.N = 1
+	p.N = 1
+	(*p).N = 1
+	p.Arr[0] = 1
+	**pp = T{}
+	os.Args = nil
+	os.Args[0] = ""
+	f2().N = 1
+
+	println(x, arr[0], t.N)
+}
+
+func f2() *T { return nil }
+`
+
+func TestRootIdent(t *testing.T) {
+	file, _, info := typeCheck(t, rootIdentSrc)
+
+	type root struct {
+		name     string
+		indirect bool
+	}
+	expected := map[string]root{
+		"x":          {"x", false},
+		"(x)":        {"x", false},
+		"s[0]":       {"s", true},
+		"m[\"a\"]":   {"m", true},
+		"arr[0]":     {"arr", false},
+		"t.N":        {"t", false},
+		"t.Arr[0]":   {"t", false},
+		"t.S[0]":     {"t", true},
+		"t.P.N":      {"t", true},
+		"p.N":        {"p", true},
+		"(*p).N":     {"p", true},
+		"p.Arr[0]":   {"p", true},
+		"**pp":       {"pp", true},
+		"os.Args":    {"Args", false},
+		"os.Args[0]": {"Args", true},
+		"f2().N":     {"", false},
+	}
+
+	seen := 0
+	ast.Inspect(file, func(n ast.Node) bool {
+		assign, ok := n.(*ast.AssignStmt)
+		if !ok {
+			return true
+		}
+
+		lhs := types.ExprString(assign.Lhs[0])
+		want, ok := expected[lhs]
+		if !ok {
+			t.Errorf("unexpected assignment to %s", lhs)
+			return true
+		}
+		seen++
+
+		ident, indirect := rootIdent(assign.Lhs[0], info)
+		name := ""
+		if ident != nil {
+			name = ident.Name
+		}
+		if name != want.name || indirect != want.indirect {
+			t.Errorf("%s: expected (%q, %v), got (%q, %v)", lhs, want.name, want.indirect, name, indirect)
+		}
+		return true
+	})
+	if seen != len(expected) {
+		t.Errorf("expected %d assignments, got %d", len(expected), seen)
+	}
+}
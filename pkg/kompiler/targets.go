@@ -0,0 +1,353 @@
+package kompiler
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strings"
+
+	"github.com/samber/lo"
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/types/typeutil"
+
+	"github.com/acrlabs/kompile/pkg/controller"
+	"github.com/acrlabs/kompile/pkg/util"
+)
+
+// offloadTarget is the function called by a go statement, normalized so that everything the function needs from the
+// caller (its receiver, any variables captured by a closure, and its regular arguments) is passed in explicitly
+type offloadTarget struct {
+	name string
+
+	// key identifies the function being called, so that the same function called from several places only gets
+	// turned into one service; fn is the function object itself, and is nil for closures
+	key any
+	fn  *types.Func
+
+	// decl is the declaration of the function that ends up in the service; for closures, the function literal is
+	// lifted into a new declaration whose leading parameters are the captured variables
+	decl *ast.FuncDecl
+	sig  *types.Signature
+
+	// decls are the other package-level declarations (functions, types and their methods, variables, and constants)
+	// that decl depends on, directly or indirectly, and that have to be copied into the service along with it;
+	// imports are the packages that decl and decls refer to
+	decls   []ast.Decl
+	imports []util.Import
+
+	// recv is the receiver expression for method calls, captures are the free variables of a closure, and args are
+	// the arguments that match the parameters of sig
+	recv     ast.Expr
+	recvType string
+	captures []*types.Var
+	args     []ast.Expr
+
+	// pod is the configuration for the pods that run the service, from the directives on the function
+	pod *util.PodConfig
+
+	// params is filled in once we've checked that all of the above can actually be sent to a service, and warnings
+	// holds anything we noticed along the way that doesn't stop the function from being offloaded
+	params   *serviceArgs
+	warnings []string
+}
+
+// resolveTarget figures out what function a go statement is calling, and whether it can be offloaded; if it can't,
+// the returned error explains why
+func (self *Kompiler) resolveTarget(file *ast.File, goStmt *ast.GoStmt) (*offloadTarget, error) {
+	target, err := self.findTarget(file, goStmt)
+	if err != nil {
+		return nil, err
+	}
+
+	info := self.mainPkg.TypesInfo
+	if target.fn != nil {
+		info = self.pkgsByTypes[target.fn.Pkg()].TypesInfo
+	}
+	if err := checkLocalTypes(target, info); err != nil {
+		return nil, err
+	}
+
+	if target.recv != nil {
+		if err := checkSerializable(self.mainPkg.TypesInfo.TypeOf(target.recv)); err != nil {
+			return nil, fmt.Errorf("receiver %s: %w", types.ExprString(target.recv), err)
+		}
+	}
+
+	pod, err := parseDirectives(self.directiveComments(file, goStmt, target))
+	if err != nil {
+		return nil, err
+	}
+	target.pod = pod
+
+	if !argsMatchParams(goStmt.Call, target, self.mainPkg.TypesInfo) {
+		return nil, fmt.Errorf("multi-value call arguments are not supported")
+	}
+
+	// The service always gets the trailing arguments of a variadic function as a single slice
+	if target.sig.Variadic() && goStmt.Call.Ellipsis == token.NoPos {
+		target.args = packVariadic(target, self.mainPkg.Types)
+	}
+
+	params, err := selectServiceArgs(target, self.mainPkg)
+	if err != nil {
+		return nil, err
+	}
+	target.params = params
+	inbound := lo.SomeBy(params.channels, func(ch controller.Channel) bool { return ch.Inbound })
+	if inbound && self.runtime == controller.JobRuntime {
+		return nil, fmt.Errorf("can't send values to a function that runs as a job")
+	}
+
+	warnings, err := self.checkSafety(target)
+	if err != nil {
+		return nil, err
+	}
+	target.warnings = append(warnings, params.selectResults(target)...)
+	target.decls, target.imports = self.dependencies(target)
+	target.name = self.serviceName(target)
+	return target, nil
+}
+
+// serviceName makes sure that every offloaded function gets a service of its own: functions from different packages,
+// methods, and closures can all end up with the same name (e.g. a/util.Run and b/util.Run), so a number is added to
+// the name of any service that would otherwise clash with one we've already seen
+func (self *Kompiler) serviceName(target *offloadTarget) string {
+	if name, ok := self.serviceNames[target.key]; ok {
+		return name
+	}
+
+	name := target.name
+	for i := 2; self.takenNames[util.ResourceName(name)]; i++ {
+		name = fmt.Sprintf("%s%d", target.name, i)
+	}
+	if target.fn == nil {
+		// The lifted closure is named after its service too, so it can't clash with anything else in the service
+		target.decl.Name.Name = name
+	}
+	self.serviceNames[target.key] = name
+	self.takenNames[util.ResourceName(name)] = true
+	return name
+}
+
+func (self *Kompiler) findTarget(file *ast.File, goStmt *ast.GoStmt) (*offloadTarget, error) {
+	info := self.mainPkg.TypesInfo
+	if lit, ok := goStmt.Call.Fun.(*ast.FuncLit); ok {
+		return self.liftClosure(file, goStmt, lit)
+	}
+
+	fn := typeutil.StaticCallee(info, goStmt.Call)
+	if fn == nil {
+		return nil, fmt.Errorf("%s is not a statically-known function", types.ExprString(goStmt.Call.Fun))
+	}
+	fn = fn.Origin()
+
+	decl, ok := self.functions[fn]
+	if !ok {
+		return nil, fmt.Errorf("%s is not declared in module %s", fn.FullName(), self.module.Path)
+	}
+
+	sig, _ := fn.Type().(*types.Signature)
+	if sig.TypeParams().Len() > 0 || sig.RecvTypeParams().Len() > 0 {
+		return nil, fmt.Errorf("%s is generic", fn.FullName())
+	}
+
+	target := &offloadTarget{
+		key:  fn,
+		fn:   fn,
+		decl: decl,
+		sig:  sig,
+		args: goStmt.Call.Args,
+	}
+
+	if sig.Recv() == nil {
+		target.name = fn.Name()
+		if fn.Pkg() != self.mainPkg.Types {
+			target.name = fn.Pkg().Name() + upperFirst(fn.Name())
+		}
+		return target, nil
+	}
+
+	// A method expression (T.method) takes its receiver as the first argument rather than from the selector
+	sel, ok := goStmt.Call.Fun.(*ast.SelectorExpr)
+	selection := info.Selections[sel]
+	if !ok || selection == nil || selection.Kind() != types.MethodVal {
+		return nil, fmt.Errorf("method expression %s is not supported", types.ExprString(goStmt.Call.Fun))
+	}
+
+	// Methods that are promoted from an embedded field would need the embedded value as their receiver, not the
+	// value that the method was called on
+	if len(selection.Index()) != 1 {
+		return nil, fmt.Errorf("%s is promoted from an embedded field", fn.FullName())
+	}
+
+	recvNamed, ok := derefNamed(sig.Recv().Type())
+	if !ok {
+		return nil, fmt.Errorf("could not find receiver type for %s", fn.FullName())
+	}
+	if _, ok := self.typeDecls[recvNamed.Obj()]; !ok {
+		return nil, fmt.Errorf("could not find receiver type for %s", fn.FullName())
+	}
+
+	target.name = lowerFirst(recvNamed.Obj().Name()) + upperFirst(fn.Name())
+	target.recv = sel.X
+	target.recvType = types.TypeString(sig.Recv().Type(), qualifier(fn.Pkg()))
+	return target, nil
+}
+
+// liftClosure turns `go func(...) {...}(...)` into a top-level function declaration whose parameters are the free
+// variables of the closure followed by the closure's own parameters
+func (self *Kompiler) liftClosure(file *ast.File, goStmt *ast.GoStmt, lit *ast.FuncLit) (*offloadTarget, error) {
+	info := self.mainPkg.TypesInfo
+	captures := freeVars(lit, info)
+	if err := checkCaptures(lit, captures, info); err != nil {
+		return nil, err
+	}
+	qual := qualifier(self.mainPkg.Types)
+
+	captureFields := lo.Map(captures, func(v *types.Var, _ int) *ast.Field {
+		return &ast.Field{
+			Names: []*ast.Ident{{Name: v.Name()}},
+			Type:  typeExpr(v.Type(), qual),
+		}
+	})
+	captureArgs := lo.Map(captures, func(v *types.Var, _ int) ast.Expr { return &ast.Ident{Name: v.Name()} })
+
+	litSig, _ := info.TypeOf(lit).(*types.Signature)
+	params := append([]*types.Var{}, captures...)
+	for i := range litSig.Params().Len() {
+		params = append(params, litSig.Params().At(i))
+	}
+
+	enclosing := "closure"
+	path, _ := astutil.PathEnclosingInterval(file, goStmt.Pos(), goStmt.End())
+	for _, n := range path {
+		if decl, ok := n.(*ast.FuncDecl); ok {
+			enclosing = decl.Name.Name
+			break
+		}
+	}
+	self.closures[enclosing]++
+	name := fmt.Sprintf("%sFunc%d", enclosing, self.closures[enclosing])
+
+	return &offloadTarget{
+		name: name,
+		key:  lit,
+		decl: &ast.FuncDecl{
+			Name: &ast.Ident{Name: name},
+			Type: &ast.FuncType{
+				Params: &ast.FieldList{List: append(captureFields, lit.Type.Params.List...)},
+			},
+			Body: lit.Body,
+		},
+		sig:      types.NewSignatureType(nil, nil, nil, types.NewTuple(params...), litSig.Results(), litSig.Variadic()),
+		captures: captures,
+		args:     append(captureArgs, goStmt.Call.Args...),
+	}, nil
+}
+
+// argsMatchParams returns true if there's an argument expression for each of the target's parameters (once the
+// trailing arguments to a variadic function are packed into a slice); that's not the case for f(g()), where g's
+// results are passed as f's arguments
+func argsMatchParams(call *ast.CallExpr, target *offloadTarget, info *types.Info) bool {
+	if len(call.Args) == 1 {
+		if tuple, ok := info.TypeOf(call.Args[0]).(*types.Tuple); ok && tuple.Len() != 1 {
+			return false
+		}
+	}
+
+	n := target.sig.Params().Len()
+	if target.sig.Variadic() && call.Ellipsis == token.NoPos {
+		return len(target.args) >= n-1
+	}
+	return len(target.args) == n
+}
+
+// packVariadic collects the trailing arguments to a variadic function into a slice literal, so that there's exactly
+// one argument for each parameter; pkg is the package that the call is in
+func packVariadic(target *offloadTarget, pkg *types.Package) []ast.Expr {
+	n := target.sig.Params().Len()
+	last := target.sig.Params().At(n - 1)
+	return append(target.args[:n-1:n-1], &ast.CompositeLit{
+		Type: typeExpr(last.Type(), qualifier(pkg)),
+		Elts: target.args[n-1:],
+	})
+}
+
+// freeVars returns all of the local variables that are referenced from inside a closure but declared outside of it
+func freeVars(lit *ast.FuncLit, info *types.Info) []*types.Var {
+	vars := []*types.Var{}
+	ast.Inspect(lit.Body, func(n ast.Node) bool {
+		if ident, ok := n.(*ast.Ident); ok {
+			if v, ok := info.Uses[ident].(*types.Var); ok && isFreeVar(v, lit) && !lo.Contains(vars, v) {
+				vars = append(vars, v)
+			}
+		}
+		return true
+	})
+	return vars
+}
+
+func isFreeVar(v *types.Var, lit *ast.FuncLit) bool {
+	if v.IsField() || v.Parent() == nil || v.Parent() == v.Pkg().Scope() {
+		return false
+	}
+	return v.Pos() < lit.Pos() || v.Pos() >= lit.End()
+}
+
+func qualifier(pkg *types.Package) types.Qualifier {
+	return func(other *types.Package) string {
+		if other == pkg {
+			return ""
+		}
+		return other.Name()
+	}
+}
+
+func typeExpr(typ types.Type, qual types.Qualifier) ast.Expr {
+	expr, err := parser.ParseExpr(types.TypeString(typ, qual))
+	if err != nil {
+		// This shouldn't happen, since TypeString always produces a valid type expression
+		panic(fmt.Sprintf("could not parse type %s: %v", typ, err))
+	}
+	return expr
+}
+
+// typeImports returns the packages that need to be imported to refer to typ from inside pkg
+func typeImports(typ types.Type, pkg *types.Package) []util.Import {
+	imports := []util.Import{}
+	types.TypeString(typ, func(other *types.Package) string {
+		if other != pkg {
+			imports = append(imports, util.Import{Path: other.Path()})
+		}
+		return other.Name()
+	})
+	return imports
+}
+
+func derefNamed(typ types.Type) (*types.Named, bool) {
+	if ptr, ok := typ.(*types.Pointer); ok {
+		typ = ptr.Elem()
+	}
+	named, ok := typ.(*types.Named)
+	return named, ok
+}
+
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+func upperFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+func typeDeclFor(spec *ast.TypeSpec) *ast.GenDecl {
+	return &ast.GenDecl{Tok: token.TYPE, Specs: []ast.Spec{spec}}
+}
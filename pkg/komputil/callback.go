@@ -0,0 +1,322 @@
+package komputil
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// CallbackPath is where the controller listens for values sent back from the services, and where services listen for
+// values streamed to them from the controller
+const CallbackPath = "/kompile/callback"
+
+type callbackKey struct {
+	id   string
+	name string
+}
+
+// registration is something waiting on an invocation: deliver passes a value (or the close) sent from the other side
+// along to a channel, and finish is called once the invocation is over, with the error it failed with, if any
+type registration struct {
+	deliver func(data []byte, closed bool) error
+	finish  func(err error)
+}
+
+// callbacks holds the registrations for every in-flight invocation, so that a value sent from the other side ends up
+// on the channel belonging to the right invocation, even if the same function is running several times at once
+//
+//nolint:gochecknoglobals // shared by every invocation in the controller
+var callbacks sync.Map
+
+// NewInvocationID returns a random identifier for a single call to an offloaded function
+func NewInvocationID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand doesn't fail on any platform that we run on
+		panic(fmt.Sprintf("could not generate invocation ID: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// RegisterChannel routes values sent on the channel parameter called name, for the invocation with the given ID, to
+// ch.  The same channel is often passed to several invocations at once (e.g. when fanning out work), so ch is only
+// closed once every registration for it has been let go, and at least one of them asked for it to be closed: either
+// the sender closed its channel, or the invocation failed, so that nobody is left waiting on values that will never
+// arrive.  An offloaded function returning an error doesn't count as a failure here; its channels are left alone, just
+// like they would be if the function ran locally.
+func RegisterChannel[T any](id, name string, ch chan<- T) {
+	key := callbackKey{id, name}
+	shared := acquireChannel(ch, func() { close(ch) })
+
+	// A value can be in the middle of being delivered when the registration is let go, so the delivery has to give up
+	// before the channel can be closed, otherwise we'd be sending on a closed channel
+	released := make(chan struct{})
+	var releaseOnce sync.Once
+	release := func(closing bool) {
+		releaseOnce.Do(func() {
+			close(released)
+			shared.release(closing)
+		})
+	}
+
+	callbacks.Store(key, &registration{
+		deliver: func(data []byte, closing bool) error {
+			if closing {
+				callbacks.Delete(key)
+				release(true)
+				return nil
+			}
+
+			var value T
+			if err := json.Unmarshal(data, &value); err != nil {
+				return fmt.Errorf("could not decode value: %w", err)
+			}
+
+			shared.sending.RLock()
+			defer shared.sending.RUnlock()
+			if shared.closed {
+				return fmt.Errorf("channel %s is closed", name)
+			}
+			select {
+			case ch <- value:
+			case <-released:
+			}
+			return nil
+		},
+		finish: func(err error) {
+			var returned *ReturnedError
+			release(err != nil && !errors.As(err, &returned))
+		},
+	})
+}
+
+// sharedChannel counts the registrations for a single channel, across every invocation that it was passed to
+type sharedChannel struct {
+	key       any
+	closeFunc func()
+
+	// refs and closing are guarded by channelsLock
+	refs    int
+	closing bool
+
+	// sending is held (for reading) while a value is being sent on the channel, and (for writing) while it's closed
+	sending   sync.RWMutex
+	closed    bool
+	closeOnce sync.Once
+}
+
+// channels holds a sharedChannel for every channel that's registered with at least one invocation, and for every
+// channel that we've closed, so that an invocation that's handed a closed channel later on doesn't try to use it
+//
+//nolint:gochecknoglobals // shared by every invocation in the controller
+var (
+	channels     = map[any]*sharedChannel{}
+	channelsLock sync.Mutex
+)
+
+// acquireChannel adds a registration for ch; closeFunc closes it once the last registration is let go, if needed
+func acquireChannel(ch any, closeFunc func()) *sharedChannel {
+	channelsLock.Lock()
+	defer channelsLock.Unlock()
+
+	shared, ok := channels[ch]
+	if !ok {
+		shared = &sharedChannel{key: ch, closeFunc: closeFunc}
+		channels[ch] = shared
+	}
+	shared.refs++
+	return shared
+}
+
+// release lets go of one registration for the channel; if it was the last one and any of them asked for the channel
+// to be closed, it's closed now.  A closed channel stays in channels, so that it's never closed (or sent on) again.
+func (self *sharedChannel) release(closing bool) {
+	channelsLock.Lock()
+	self.refs--
+	self.closing = self.closing || closing
+	closeIt := self.refs == 0 && self.closing
+	if self.refs == 0 && !self.closing {
+		delete(channels, self.key)
+	}
+	channelsLock.Unlock()
+
+	if closeIt {
+		self.closeOnce.Do(func() {
+			self.sending.Lock()
+			defer self.sending.Unlock()
+			self.closed = true
+			self.closeFunc()
+		})
+	}
+}
+
+// RegisterForwarder stops the forwarder for the channel parameter called name once the invocation with the given ID
+// is over; the service won't be reading from its channel anymore, whether it returned or failed
+func RegisterForwarder(id, name string, forwarder *Forwarder) {
+	callbacks.Store(callbackKey{id, name}, &registration{
+		finish: func(error) { forwarder.Cancel() },
+	})
+}
+
+// Fail reports that the invocation with the given ID failed; everything that's registered for it is let go
+func Fail(id string, err error) {
+	finishInvocation(id, err)
+}
+
+// finishInvocation removes every registration for the invocation with the given ID, and tells each of them how the
+// invocation ended; it's fine to call this more than once, since only the first call finds anything
+func finishInvocation(id string, err error) {
+	callbacks.Range(func(key, _ any) bool {
+		k, ok := key.(callbackKey)
+		if !ok || k.id != id {
+			return true
+		}
+		if value, ok := callbacks.LoadAndDelete(key); ok {
+			if reg, ok := value.(*registration); ok && reg.finish != nil {
+				reg.finish(err)
+			}
+		}
+		return true
+	})
+}
+
+// HandleCallback is the handler for values sent to any of the registered channels
+func HandleCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	key := callbackKey{query.Get("id"), query.Get("chan")}
+	closed := query.Has("closed")
+	fmt.Printf("received value for %s on invocation %s\n", key.name, key.id)
+
+	value, _ := callbacks.Load(key)
+	reg, ok := value.(*registration)
+	if !ok || reg.deliver == nil {
+		http.Error(w, fmt.Sprintf("unknown channel %s for invocation %s", key.name, key.id), http.StatusNotFound)
+		return
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not read value: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := reg.deliver(data, closed); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Callback sends the values from a channel on one side (usually the service) to the other, which passes them along
+// to its registered channel
+type Callback struct {
+	url string
+}
+
+func NewCallback(baseURL, id, name string) *Callback {
+	query := url.Values{"id": {id}, "chan": {name}}
+	return &Callback{url: baseURL + CallbackPath + "?" + query.Encode()}
+}
+
+// Send JSON-encodes value and sends it to the other side
+func (self *Callback) Send(value any) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("could not encode value: %w", err)
+	}
+	return self.post(self.url, b)
+}
+
+// Close tells the other side that the channel was closed
+func (self *Callback) Close() error {
+	return self.post(self.url+"&closed", nil)
+}
+
+func (self *Callback) post(url string, body []byte) error {
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body)) //nolint:gosec // url is built by kompile
+	if err != nil {
+		return fmt.Errorf("could not send value: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not send value: %s", resp.Status)
+	}
+	return nil
+}
+
+// Forwarder sends everything from a channel to the other side
+type Forwarder struct {
+	stop       chan struct{}
+	cancel     chan struct{}
+	cancelOnce sync.Once
+	done       chan struct{}
+}
+
+// Forward starts sending every value received on ch back through cb, in order, until ch is closed (in which case
+// the other side closes its channel as well) or Stop or Cancel is called
+func Forward[T any](cb *Callback, ch <-chan T) *Forwarder {
+	self := &Forwarder{stop: make(chan struct{}), cancel: make(chan struct{}), done: make(chan struct{})}
+
+	// forward sends one value (or the close) back to the controller, and returns false once the channel is closed
+	forward := func(value T, ok bool) bool {
+		if !ok {
+			if err := cb.Close(); err != nil {
+				fmt.Printf("could not close channel: %v\n", err)
+			}
+			return false
+		}
+		if err := cb.Send(value); err != nil {
+			fmt.Printf("could not send value: %v\n", err)
+		}
+		return true
+	}
+
+	go func() {
+		defer close(self.done)
+		for {
+			select {
+			case value, ok := <-ch:
+				if !forward(value, ok) {
+					return
+				}
+			case <-self.cancel:
+				return
+			case <-self.stop:
+				// The function might have closed the channel (or left something in a buffered channel) right before
+				// returning, so pick up anything that's already there before we stop
+				for {
+					select {
+					case value, ok := <-ch:
+						if !forward(value, ok) {
+							return
+						}
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+	return self
+}
+
+// Stop is called once the offloaded function returns; nothing else will be sent on the channel after that (unless
+// the function left something running in the background), so we finish sending whatever is in flight and then stop
+func (self *Forwarder) Stop() {
+	close(self.stop)
+	<-self.done
+}
+
+// Cancel stops forwarding right away, without waiting for anything in flight; it's used once the other side has gone
+// away, so there's nobody left to send to
+func (self *Forwarder) Cancel() {
+	self.cancelOnce.Do(func() { close(self.cancel) })
+}
@@ -0,0 +1,114 @@
+package komputil
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func deliver(t *testing.T, id, name, body string) int {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, CallbackPath+"?id="+id+"&chan="+name, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	HandleCallback(w, req)
+	return w.Code
+}
+
+func isClosed(ch <-chan int) bool {
+	select {
+	case _, ok := <-ch:
+		return !ok
+	default:
+		return false
+	}
+}
+
+func TestRegisterChannel(t *testing.T) {
+	for name, tc := range map[string]struct {
+		errs   []error
+		closed bool
+	}{
+		"all returned":           {errs: []error{nil, nil}, closed: false},
+		"returned error":         {errs: []error{&ReturnedError{"oops"}, nil}, closed: false},
+		"one failed":             {errs: []error{errors.New("pod died"), nil}, closed: true},
+		"last returned an error": {errs: []error{errors.New("pod died"), &ReturnedError{"oops"}}, closed: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ch := make(chan int, 1)
+			ids := []string{NewInvocationID(), NewInvocationID()}
+			for _, id := range ids {
+				RegisterChannel(id, "out", ch)
+			}
+
+			for i, id := range ids {
+				if code := deliver(t, id, "out", "1"); code != http.StatusOK {
+					t.Fatalf("could not deliver value: %d", code)
+				}
+				if value := <-ch; value != 1 {
+					t.Fatalf("expected 1, got %d", value)
+				}
+
+				finishInvocation(id, tc.errs[i])
+				if i < len(ids)-1 && isClosed(ch) {
+					t.Fatalf("channel closed while invocation %d is still running", i+1)
+				}
+			}
+
+			if closed := isClosed(ch); closed != tc.closed {
+				t.Errorf("expected closed=%v, got %v", tc.closed, closed)
+			}
+		})
+	}
+}
+
+func TestRegisterChannelSenderClosed(t *testing.T) {
+	ch := make(chan int)
+	first, second := NewInvocationID(), NewInvocationID()
+	RegisterChannel(first, "out", ch)
+	RegisterChannel(second, "out", ch)
+
+	if code := deliver(t, first, "out&closed", ""); code != http.StatusOK {
+		t.Fatalf("could not close channel: %d", code)
+	}
+	if isClosed(ch) {
+		t.Fatal("channel closed while the second invocation is still running")
+	}
+
+	// The second invocation is still sending, and the registration for the first one is gone
+	go deliver(t, second, "out", "2")
+	if value := <-ch; value != 2 {
+		t.Fatalf("expected 2, got %d", value)
+	}
+	if code := deliver(t, first, "out", "1"); code != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, code)
+	}
+
+	finishInvocation(second, nil)
+	if !isClosed(ch) {
+		t.Error("channel not closed once every invocation let go of it")
+	}
+}
+
+func TestRegisterChannelAfterFailure(t *testing.T) {
+	ch := make(chan int, 1)
+	first := NewInvocationID()
+	RegisterChannel(first, "out", ch)
+	Fail(first, errors.New("could not encode request"))
+	if !isClosed(ch) {
+		t.Fatal("channel not closed after the invocation failed")
+	}
+
+	// The channel is already closed, so a later invocation can't send on it, and failing again doesn't close it twice
+	second := NewInvocationID()
+	RegisterChannel(second, "out", ch)
+	if code := deliver(t, second, "out", "2"); code != http.StatusBadRequest {
+		t.Errorf("expected %d, got %d", http.StatusBadRequest, code)
+	}
+	Fail(second, errors.New("pod died"))
+
+	third := NewInvocationID()
+	RegisterChannel(third, "out", ch)
+	finishInvocation(third, nil)
+}
@@ -0,0 +1,127 @@
+package komputil
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	watchtools "k8s.io/client-go/tools/watch"
+)
+
+// DeploymentRuntime sends each invocation to the long-running service for its function, through the service's
+// Kubernetes Service, which picks one of its pods; if the invocation is stopped early, it's cancelled on that pod.
+type DeploymentRuntime struct{}
+
+// deploymentCall is where an invocation is running: the service's Kubernetes Service, and once the invocation is
+// accepted, the pod that's running it, if the service knows
+type deploymentCall struct {
+	serviceURL string
+	podURL     string
+	pod        string
+}
+
+// Launch doesn't have anything to start, since the Deployment is already running
+func (self *DeploymentRuntime) Launch(_ context.Context, inv *Invocation) error {
+	serviceURL := fmt.Sprintf("http://%s:8080", inv.Config.Name)
+	inv.Instance = &deploymentCall{serviceURL: serviceURL, podURL: serviceURL}
+	return nil
+}
+
+func (self *DeploymentRuntime) Invoke(_ context.Context, inv *Invocation) (string, error) {
+	call, _ := inv.Instance.(*deploymentCall)
+	accepted, err := sendRequest(call.serviceURL, inv.Request)
+	if err != nil {
+		return "", err
+	}
+	if accepted.URL != "" {
+		call.podURL = accepted.URL
+	}
+	call.pod = accepted.Pod
+	return call.podURL, nil
+}
+
+// Await watches the pod running the invocation, if we know which one it is
+func (self *DeploymentRuntime) Await(inv *Invocation) error {
+	call, _ := inv.Instance.(*deploymentCall)
+	if call.pod == "" {
+		<-inv.Done()
+		return nil
+	}
+
+	ctx, cancel := inv.context()
+	defer cancel()
+	return watchWorker(ctx, call.pod)
+}
+
+func (self *DeploymentRuntime) Cancel(inv *Invocation) error {
+	call, _ := inv.Instance.(*deploymentCall)
+	return cancelInvocation(call.podURL, inv.ID)
+}
+
+// Teardown doesn't have anything to clean up, since the Deployment keeps running
+func (self *DeploymentRuntime) Teardown(*Invocation, error) {}
+
+func cancelInvocation(podURL, id string) error {
+	cancelURL := podURL + CancelPath + "?" + url.Values{"id": {id}}.Encode()
+	resp, err := http.Post(cancelURL, "application/json", nil) //nolint:gosec // url is built by kompile
+	if err != nil {
+		return fmt.Errorf("could not send cancellation: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not send cancellation: %s", resp.Status)
+	}
+	return nil
+}
+
+// watchWorker watches the pod called name until ctx is done, in which case it returns nil, or until the pod restarts
+// or goes away; long-running services are restarted if they crash, so unlike with a pod of its own, we look for the
+// container restarting rather than the pod exiting
+func watchWorker(ctx context.Context, name string) error {
+	clientset, namespace := newClientset()
+	lw := podListWatch(clientset, namespace, name)
+	restarts := -1
+	_, err := watchtools.UntilWithSync(ctx, lw, &corev1.Pod{}, podExists(name), func(event watch.Event) (bool, error) {
+		if event.Type == watch.Deleted {
+			return false, fmt.Errorf("pod %s was deleted", name)
+		}
+		pod, ok := event.Object.(*corev1.Pod)
+		if !ok {
+			return false, nil
+		}
+
+		count, reason := restartCount(pod)
+		if restarts >= 0 && count > restarts {
+			return false, fmt.Errorf("pod %s restarted: %s", name, reason)
+		}
+		restarts = count
+		return false, nil
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	return fmt.Errorf("lost the service running the invocation: %w", err)
+}
+
+// restartCount returns how many times the pod's containers have restarted, and why the last one stopped
+func restartCount(pod *corev1.Pod) (int, string) {
+	count := 0
+	reason := ""
+	for _, status := range pod.Status.ContainerStatuses {
+		count += int(status.RestartCount)
+		if term := status.LastTerminationState.Terminated; term != nil {
+			reason = fmt.Sprintf("exit code %d", term.ExitCode)
+			if term.ExitCode == PanicExitCode {
+				reason = "the offloaded function panicked"
+			}
+			if term.Reason != "" {
+				reason += " (" + term.Reason + ")"
+			}
+		}
+	}
+	return count, reason
+}
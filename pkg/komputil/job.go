@@ -0,0 +1,237 @@
+package komputil
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	watchtools "k8s.io/client-go/tools/watch"
+)
+
+const (
+	// RequestFileEnv is the path to the request for services that run as a Job; the request is stored in a Secret that's
+	// mounted into the Job's pods, rather than being sent to the pod once it's running, so that the Job can retry the
+	// invocation in a new pod by itself
+	RequestFileEnv = "KOMPILE_REQUEST_FILE"
+
+	// JobBackoffLimitEnv is how many times a Job retries an invocation whose pod fails, JobTTLEnv is how long a
+	// finished Job is kept around before it's deleted, and JobDeadlineEnv is how long a Job can run for in total
+	JobBackoffLimitEnv = "KOMPILE_JOB_BACKOFF_LIMIT"
+	JobTTLEnv          = "KOMPILE_JOB_TTL"
+	JobDeadlineEnv     = "KOMPILE_JOB_DEADLINE"
+
+	defaultJobBackoffLimit = 3
+	defaultJobTTL          = 10 * time.Minute
+	defaultJobDeadline     = time.Hour
+
+	// maxRequestSize is the most that fits in a Secret
+	maxRequestSize = 1 << 20
+
+	requestVolume = "kompile-request"
+	requestDir    = "/var/run/kompile"
+	requestKey    = "request.json"
+)
+
+// JobRuntime runs each invocation as a Job.  If the pod fails, the Job retries the invocation in a new one, so anything
+// the function sends back before it fails is sent again; the invocation only fails once the Job has given up.  Finished
+// Jobs are deleted automatically after a while.  If the invocation is stopped early, the Job is deleted, which cancels
+// the function's context in the service.  There's no pod to talk to while the invocation runs, so Invoke doesn't return
+// a URL.
+type JobRuntime struct{}
+
+// jobCall is the Secret with an invocation's request, and once it's been created, the Job that runs it
+type jobCall struct {
+	clientset kubernetes.Interface
+	namespace string
+	secret    *corev1.Secret
+	job       string
+}
+
+// Launch stores the request in a Secret, which is mounted into the Job's pods
+func (self *JobRuntime) Launch(ctx context.Context, inv *Invocation) error {
+	if len(inv.Request) > maxRequestSize {
+		return fmt.Errorf(
+			"could not invoke %s: the request is %d bytes, but at most %d bytes fit in a Secret",
+			inv.Config.Name, len(inv.Request), maxRequestSize,
+		)
+	}
+
+	clientset, namespace := newClientset()
+	secret, err := clientset.CoreV1().Secrets(namespace).Create(ctx, &corev1.Secret{
+		ObjectMeta: ownedObjectMeta(namespace, inv.Config.Name),
+		Data:       map[string][]byte{requestKey: inv.Request},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("could not create secret for request: %w", err)
+	}
+	inv.Instance = &jobCall{clientset: clientset, namespace: namespace, secret: secret}
+	return nil
+}
+
+// Invoke creates the Job, which starts the invocation by itself
+func (self *JobRuntime) Invoke(ctx context.Context, inv *Invocation) (string, error) {
+	call, _ := inv.Instance.(*jobCall)
+	config := inv.Config
+	spec, err := podSpec(config, []corev1.EnvVar{{Name: RequestFileEnv, Value: requestDir + "/" + requestKey}})
+	if err != nil {
+		return "", err
+	}
+	mountRequest(spec, call.secret.Name)
+
+	backoffLimit := int32(intEnv(JobBackoffLimitEnv, defaultJobBackoffLimit))
+	ttl := int32(durationEnv(JobTTLEnv, defaultJobTTL).Seconds())
+	deadline := int64(durationEnv(JobDeadlineEnv, defaultJobDeadline).Seconds())
+	job := batchv1.Job{
+		ObjectMeta: ownedObjectMeta(call.namespace, config.Name),
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            &backoffLimit,
+			TTLSecondsAfterFinished: &ttl,
+			ActiveDeadlineSeconds:   &deadline,
+
+			// Panics are reported back to the controller before the service exits, so there's no point in trying again
+			PodFailurePolicy: &batchv1.PodFailurePolicy{
+				Rules: []batchv1.PodFailurePolicyRule{{
+					Action: batchv1.PodFailurePolicyActionFailJob,
+					OnExitCodes: &batchv1.PodFailurePolicyOnExitCodesRequirement{
+						Operator: batchv1.PodFailurePolicyOnExitCodesOpIn,
+						Values:   []int32{PanicExitCode},
+					},
+				}},
+			},
+			Template: corev1.PodTemplateSpec{Spec: *spec},
+		},
+	}
+
+	created, err := call.clientset.BatchV1().Jobs(call.namespace).Create(ctx, &job, metav1.CreateOptions{})
+	if err != nil {
+		return "", fmt.Errorf("could not create job: %w", err)
+	}
+	call.job = created.ObjectMeta.Name
+	fmt.Printf("started job %s for %s (invocation %s)\n", call.job, config.Name, inv.ID)
+
+	// The request has to stick around for as long as the Job might retry the invocation, and no longer
+	if err := handOver(call.clientset, call.secret, created); err != nil {
+		fmt.Printf("could not hand request over to job %s: %v\n", call.job, err)
+	}
+	return "", nil
+}
+
+// Await waits for the Job to finish; the service always sends back its results before it exits, so if the invocation
+// is still going by then, the Job must have given up on it
+func (self *JobRuntime) Await(inv *Invocation) error {
+	call, _ := inv.Instance.(*jobCall)
+	ctx, cancel := inv.context()
+	defer cancel()
+	return watchJob(ctx, call.clientset, call.namespace, call.job)
+}
+
+func (self *JobRuntime) Cancel(inv *Invocation) error {
+	call, _ := inv.Instance.(*jobCall)
+	return deleteJob(call.clientset, call.namespace, call.job)
+}
+
+// Teardown deletes the request if the Job was never created; otherwise it's deleted along with the Job
+func (self *JobRuntime) Teardown(inv *Invocation, _ error) {
+	call, _ := inv.Instance.(*jobCall)
+	if call.job == "" {
+		if err := deleteSecret(call.clientset, call.namespace, call.secret.Name); err != nil {
+			fmt.Printf("could not delete request for %s: %v\n", inv.Config.Name, err)
+		}
+	}
+}
+
+// mountRequest mounts the request from the Secret called secretName into the pod
+func mountRequest(spec *corev1.PodSpec, secretName string) {
+	spec.Volumes = append(spec.Volumes, corev1.Volume{
+		Name:         requestVolume,
+		VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: secretName}},
+	})
+	spec.Containers[0].VolumeMounts = append(spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+		Name:      requestVolume,
+		MountPath: requestDir,
+		ReadOnly:  true,
+	})
+}
+
+// handOver makes the Job the only owner of the Secret with its request, so that the Secret is deleted along with it
+func handOver(clientset kubernetes.Interface, secret *corev1.Secret, job *batchv1.Job) error {
+	secret.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: batchv1.SchemeGroupVersion.String(),
+		Kind:       "Job",
+		Name:       job.Name,
+		UID:        job.UID,
+	}}
+	_, err := clientset.CoreV1().Secrets(secret.Namespace).Update(context.Background(), secret, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("could not update secret %s: %w", secret.Name, err)
+	}
+	return nil
+}
+
+// watchJob watches the Job called name until ctx is done, in which case it returns nil, or until the Job finishes or
+// goes away
+func watchJob(ctx context.Context, clientset kubernetes.Interface, namespace, name string) error {
+	lw := cache.NewListWatchFromClient(
+		clientset.BatchV1().RESTClient(),
+		"jobs",
+		namespace,
+		fields.OneTermEqualSelector("metadata.name", name),
+	)
+
+	_, err := watchtools.UntilWithSync(ctx, lw, &batchv1.Job{}, nil, func(event watch.Event) (bool, error) {
+		if event.Type == watch.Deleted {
+			return false, fmt.Errorf("job %s was deleted", name)
+		}
+		job, ok := event.Object.(*batchv1.Job)
+		if !ok {
+			return false, nil
+		}
+
+		for _, cond := range job.Status.Conditions {
+			if cond.Status != corev1.ConditionTrue {
+				continue
+			}
+			switch cond.Type {
+			case batchv1.JobFailed:
+				return false, fmt.Errorf("job %s failed: %s: %s", name, cond.Reason, cond.Message)
+			case batchv1.JobComplete:
+				return false, fmt.Errorf("job %s finished without sending back its results", name)
+			}
+		}
+		return false, nil
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	return fmt.Errorf("lost the job running the invocation: %w", err)
+}
+
+func deleteJob(clientset kubernetes.Interface, namespace, name string) error {
+	// The Job's pods are deleted along with it, which gives the service the chance to shut down cleanly
+	propagation := metav1.DeletePropagationBackground
+	err := clientset.BatchV1().Jobs(namespace).Delete(
+		context.Background(),
+		name,
+		metav1.DeleteOptions{PropagationPolicy: &propagation},
+	)
+	if err != nil {
+		return fmt.Errorf("could not delete job %s: %w", name, err)
+	}
+	return nil
+}
+
+func deleteSecret(clientset kubernetes.Interface, namespace, name string) error {
+	err := clientset.CoreV1().Secrets(namespace).Delete(context.Background(), name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("could not delete secret %s: %w", name, err)
+	}
+	return nil
+}
@@ -2,17 +2,271 @@ package komputil
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
-	"time"
+	"slices"
+	"strings"
+	"sync"
 
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	watchtools "k8s.io/client-go/tools/watch"
 )
 
-func CreateAndWaitForPod(name, image string) (string, error) {
+// Pod is a running pod for an offloaded function; it's watched from the moment it starts running, so that whichever
+// invocation it's running fails if the pod exits before the service sends back its results (see PodRuntime.Await)
+type Pod struct {
+	URL string
+
+	name      string
+	namespace string
+	clientset kubernetes.Interface
+
+	// exited is set once the pod has been deleted or has exited, so that it isn't handed out again; done is closed
+	// once the pod is gone, and err says why
+	lock   sync.Mutex
+	exited bool
+	done   chan struct{}
+	err    error
+}
+
+// stuckReasons are the reasons for a container to be waiting that it won't recover from by itself
+//
+//nolint:gochecknoglobals // constant lookup table
+var stuckReasons = []string{
+	"ErrImagePull",
+	"ImagePullBackOff",
+	"InvalidImageName",
+	"CreateContainerConfigError",
+	"CreateContainerError",
+	"CrashLoopBackOff",
+}
+
+// PodConfig describes the pods for the offloaded function called Name: the image that runs its service, the resources
+// that its container requests, the directories on the node that are mounted into it, and which nodes it can run on.
+// Service is the name of the service's directory in the compiler's output, which is where LocalRuntime finds it.
+type PodConfig struct {
+	Name         string
+	Service      string
+	Image        string
+	Resources    map[string]string
+	Volumes      []Volume
+	NodeSelector map[string]string
+}
+
+// Volume is a directory on the node that's mounted into the service's container at MountPath
+type Volume struct {
+	HostPath  string
+	MountPath string
+}
+
+// CreateAndWaitForPod starts a pod for the offloaded function described by config, and returns it once it's ready,
+// meaning that the service is listening for requests; if worker is set, the service keeps serving invocations until the
+// pod is deleted (see Service).  If the pod can't start, or ctx is done before it's ready, the pod is deleted again.
+func CreateAndWaitForPod(ctx context.Context, config *PodConfig, worker bool) (*Pod, error) {
+	clientset, namespace := newClientset()
+	env := []corev1.EnvVar{}
+	if worker {
+		env = append(env, corev1.EnvVar{Name: WorkerEnv, Value: "true"})
+	}
+
+	spec, err := podSpec(config, env)
+	if err != nil {
+		return nil, err
+	}
+	pod := corev1.Pod{
+		ObjectMeta: ownedObjectMeta(namespace, config.Name),
+		Spec:       *spec,
+	}
+
+	createdPod, err := clientset.CoreV1().Pods(namespace).Create(
+		ctx,
+		&pod,
+		metav1.CreateOptions{},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not create pod: %w", err)
+	}
+	self := &Pod{
+		name:      createdPod.ObjectMeta.Name,
+		namespace: namespace,
+		clientset: clientset,
+		done:      make(chan struct{}),
+	}
+
+	readyPod, err := self.waitUntilReady(ctx, createdPod)
+	if err != nil {
+		return nil, errors.Join(err, self.Delete())
+	}
+
+	go self.watch()
+	self.URL = fmt.Sprintf("http://%s:8080", readyPod.Status.PodIP)
+	return self, nil
+}
+
+// waitUntilReady watches the pod until it's ready, or until it ends up in a state that it's not going to get out of
+func (self *Pod) waitUntilReady(ctx context.Context, created *corev1.Pod) (*corev1.Pod, error) {
+	lw := podListWatch(self.clientset, self.namespace, self.name)
+	last := created
+	event, err := watchtools.UntilWithSync(ctx, lw, &corev1.Pod{}, nil, func(event watch.Event) (bool, error) {
+		if event.Type == watch.Deleted {
+			return false, fmt.Errorf("pod %s was deleted before it was ready", self.name)
+		}
+		pod, ok := event.Object.(*corev1.Pod)
+		if !ok {
+			return false, nil
+		}
+
+		last = pod
+		if err := startFailure(pod); err != nil {
+			return false, err
+		}
+		return isReady(pod), nil
+	})
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, fmt.Errorf("gave up waiting for pod %s (%s): %w", self.name, pendingReason(last), ctxErr)
+		}
+		return nil, fmt.Errorf("pod %s could not start: %w", self.name, err)
+	}
+
+	pod, ok := event.Object.(*corev1.Pod)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object while watching pod %s: %T", self.name, event.Object)
+	}
+	return pod, nil
+}
+
+// podListWatch lists and watches the single pod called name
+func podListWatch(clientset kubernetes.Interface, namespace, name string) *cache.ListWatch {
+	return cache.NewListWatchFromClient(
+		clientset.CoreV1().RESTClient(),
+		"pods",
+		namespace,
+		fields.OneTermEqualSelector("metadata.name", name),
+	)
+}
+
+// podExists is a precondition for watching a pod that's supposed to be there already; without it, we'd wait forever
+// for a pod that was deleted before we started watching
+func podExists(name string) watchtools.PreconditionFunc {
+	return func(store cache.Store) (bool, error) {
+		if len(store.List()) == 0 {
+			return false, fmt.Errorf("pod %s was deleted", name)
+		}
+		return false, nil
+	}
+}
+
+// startFailure returns an error if the pod isn't going to become ready
+func startFailure(pod *corev1.Pod) error {
+	if pod.Status.Phase == corev1.PodFailed || pod.Status.Phase == corev1.PodSucceeded {
+		return fmt.Errorf("exited before it was ready: %s", exitReason(pod))
+	}
+
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodScheduled && cond.Status == corev1.ConditionFalse &&
+			cond.Reason == corev1.PodReasonUnschedulable {
+			return fmt.Errorf("could not be scheduled: %s", cond.Message)
+		}
+	}
+
+	for _, status := range pod.Status.ContainerStatuses {
+		if waiting := status.State.Waiting; waiting != nil && slices.Contains(stuckReasons, waiting.Reason) {
+			return fmt.Errorf("container %s is stuck in %s: %s", status.Name, waiting.Reason, waiting.Message)
+		}
+	}
+	return nil
+}
+
+// isReady returns true once the pod has passed its readiness probe, i.e. the service is accepting connections
+func isReady(pod *corev1.Pod) bool {
+	if pod.Status.Phase != corev1.PodRunning {
+		return false
+	}
+	return slices.ContainsFunc(pod.Status.Conditions, func(cond corev1.PodCondition) bool {
+		return cond.Type == corev1.PodReady && cond.Status == corev1.ConditionTrue
+	})
+}
+
+// pendingReason describes what a pod that isn't ready yet is waiting for
+func pendingReason(pod *corev1.Pod) string {
+	for _, status := range pod.Status.ContainerStatuses {
+		if waiting := status.State.Waiting; waiting != nil && waiting.Reason != "" {
+			return "container " + strings.ToLower(waiting.Reason)
+		}
+	}
+	if pod.Status.Phase == corev1.PodRunning {
+		return "running but not ready"
+	}
+	return "still " + strings.ToLower(string(pod.Status.Phase))
+}
+
+// podSpec builds the spec for a pod that runs the service described by config, with the given environment
+func podSpec(config *PodConfig, env []corev1.EnvVar) (*corev1.PodSpec, error) {
+	requests := corev1.ResourceList{}
+	for name, value := range config.Resources {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s request for %s: %w", name, config.Name, err)
+		}
+		requests[corev1.ResourceName(name)] = quantity
+	}
+
+	hostVolumeType := corev1.HostPathDirectory
+	mounts := []corev1.VolumeMount{}
+	volumes := []corev1.Volume{}
+	for i, volume := range config.Volumes {
+		name := fmt.Sprintf("volume%d", i)
+		mounts = append(mounts, corev1.VolumeMount{Name: name, MountPath: volume.MountPath})
+		volumes = append(volumes, corev1.Volume{
+			Name: name,
+			VolumeSource: corev1.VolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{
+					Path: volume.HostPath,
+					Type: &hostVolumeType,
+				},
+			},
+		})
+	}
+
+	return &corev1.PodSpec{
+		Containers: []corev1.Container{{
+			Name:  config.Name,
+			Image: config.Image,
+			Ports: []corev1.ContainerPort{
+				{ContainerPort: 8080},
+			},
+			Env:          env,
+			Resources:    corev1.ResourceRequirements{Requests: requests},
+			VolumeMounts: mounts,
+			ReadinessProbe: &corev1.Probe{
+				ProbeHandler: corev1.ProbeHandler{
+					TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt32(8080)},
+				},
+				PeriodSeconds: 1,
+			},
+		}},
+		Volumes:       volumes,
+		NodeSelector:  config.NodeSelector,
+		RestartPolicy: corev1.RestartPolicyNever,
+	}, nil
+}
+
+// sharedClientset is used by everything in the controller that talks to the cluster; it's only created once it's
+// needed, so that nothing tries to connect to a cluster when the functions are run some other way (see LocalRuntime)
+//
+//nolint:gochecknoglobals // created once, on first use
+var sharedClientset = sync.OnceValue(func() kubernetes.Interface {
 	// creates the in-cluster config
 	config, err := rest.InClusterConfig()
 	if err != nil {
@@ -24,66 +278,87 @@ func CreateAndWaitForPod(name, image string) (string, error) {
 	if err != nil {
 		panic(err.Error())
 	}
+	return clientset
+})
 
-	namespace := os.Getenv("POD_NAMESPACE")
-	hostVolumeType := corev1.HostPathDirectory
+// newClientset returns the clientset for the cluster that the controller is running in, and the namespace it's
+// running in
+func newClientset() (kubernetes.Interface, string) {
+	return sharedClientset(), os.Getenv("POD_NAMESPACE")
+}
 
-	pod := corev1.Pod{
-		ObjectMeta: metav1.ObjectMeta{
-			Namespace:    namespace,
-			GenerateName: name + "-",
-		},
-		Spec: corev1.PodSpec{
-			Containers: []corev1.Container{{
-				Name:  name,
-				Image: image,
-				Ports: []corev1.ContainerPort{
-					{ContainerPort: 8080},
-				},
-				VolumeMounts: []corev1.VolumeMount{
-					{
-						Name:      "data",
-						MountPath: "/data",
-					},
-				},
-			}},
-			Volumes: []corev1.Volume{{
-				Name: "data",
-				VolumeSource: corev1.VolumeSource{
-					HostPath: &corev1.HostPathVolumeSource{
-						Path: "/data",
-						Type: &hostVolumeType,
-					},
-				},
-			}},
-			NodeSelector:  map[string]string{"type": "kind-worker"},
-			RestartPolicy: corev1.RestartPolicyNever,
-		},
+// Delete deletes the pod; the service gets the chance to shut down cleanly first (see Service)
+func (self *Pod) Delete() error {
+	self.lock.Lock()
+	self.exited = true
+	self.lock.Unlock()
+
+	err := self.clientset.CoreV1().Pods(self.namespace).Delete(context.Background(), self.name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("could not delete pod %s: %w", self.name, err)
 	}
+	return nil
+}
 
-	createdPod, err := clientset.CoreV1().Pods(namespace).Create(
+// Exited returns true once the pod has exited or been deleted
+func (self *Pod) Exited() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.exited
+}
+
+// watch waits for the pod to exit; the service always sends back its results before it exits, so if an invocation is
+// still going by then, the service must have crashed
+func (self *Pod) watch() {
+	defer close(self.done)
+	lw := podListWatch(self.clientset, self.namespace, self.name)
+	_, err := watchtools.UntilWithSync(
 		context.Background(),
-		&pod,
-		metav1.CreateOptions{},
+		lw,
+		&corev1.Pod{},
+		podExists(self.name),
+		func(event watch.Event) (bool, error) {
+			if event.Type == watch.Deleted {
+				return false, fmt.Errorf("pod %s was deleted", self.name)
+			}
+			pod, ok := event.Object.(*corev1.Pod)
+			if !ok {
+				return false, nil
+			}
+
+			switch pod.Status.Phase {
+			case corev1.PodFailed:
+				return false, fmt.Errorf("pod %s failed: %s", self.name, exitReason(pod))
+			case corev1.PodSucceeded:
+				return false, fmt.Errorf("pod %s exited without sending back its results", self.name)
+			default:
+				return false, nil
+			}
+		},
 	)
-	if err != nil {
-		return "", fmt.Errorf("could not create pod: %w", err)
-	}
 
-	for {
-		foundPod, err := clientset.CoreV1().Pods(namespace).Get(
-			context.Background(),
-			createdPod.ObjectMeta.Name,
-			metav1.GetOptions{},
-		)
-		if err != nil {
-			return "", fmt.Errorf("could not fetch pod: %w", err)
-		}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.exited = true
+	self.err = err
+}
 
-		if foundPod.Status.Phase == corev1.PodRunning {
-			podURL := fmt.Sprintf("http://%s:8080", foundPod.Status.PodIP)
-			return podURL, nil
+// exitReason describes why the service's container stopped
+func exitReason(pod *corev1.Pod) string {
+	for _, status := range pod.Status.ContainerStatuses {
+		if term := status.State.Terminated; term != nil {
+			reason := fmt.Sprintf("exit code %d", term.ExitCode)
+			if term.ExitCode == PanicExitCode {
+				reason = "the offloaded function panicked"
+			}
+			if term.Reason != "" {
+				reason += " (" + term.Reason + ")"
+			}
+			if term.Message != "" {
+				reason += ": " + term.Message
+			}
+			return reason
 		}
-		time.Sleep(time.Second)
 	}
+	return string(pod.Status.Phase)
 }
@@ -0,0 +1,193 @@
+package komputil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const (
+	// ListenAddrEnv is the address that a service listens on, if it isn't the usual :8080; CallbackURLEnv is where it
+	// sends values back to the controller, if it isn't the controller's Kubernetes Service
+	ListenAddrEnv  = "KOMPILE_LISTEN_ADDR"
+	CallbackURLEnv = "KOMPILE_CALLBACK_URL"
+
+	// LocalDirEnv is the directory that LocalRuntime finds the services in
+	LocalDirEnv = "KOMPILE_LOCAL_DIR"
+
+	localExeFile       = "main"
+	defaultCallbackURL = "http://localhost:8080"
+	readyPollInterval  = 100 * time.Millisecond
+)
+
+// ControllerURL returns where the service sends values back to the controller: def, unless it's been overridden (see
+// LocalRuntime)
+func ControllerURL(def string) string {
+	if url := os.Getenv(CallbackURLEnv); url != "" {
+		return url
+	}
+	return def
+}
+
+// LocalRuntime runs each service as a subprocess of the controller, so that the compiled program can run without a
+// cluster; the services' executables are found in the compiler's output, next to the controller's own directory (or in
+// LocalDirEnv), and they send values back to the controller at CallbackURLEnv (localhost:8080 by default).  Pod
+// configuration that only makes sense on a cluster, like volumes and node selectors, is ignored.
+type LocalRuntime struct {
+	dir          string
+	callbackURL  string
+	startTimeout time.Duration
+}
+
+func NewLocalRuntime() *LocalRuntime {
+	dir := os.Getenv(LocalDirEnv)
+	if dir == "" {
+		if exe, err := os.Executable(); err == nil {
+			dir = filepath.Dir(filepath.Dir(exe))
+		}
+	}
+
+	return &LocalRuntime{
+		dir:          dir,
+		callbackURL:  ControllerURL(defaultCallbackURL),
+		startTimeout: durationEnv(StartTimeoutEnv, defaultStartTimeout),
+	}
+}
+
+func (self *LocalRuntime) Launch(ctx context.Context, inv *Invocation) error {
+	proc, err := self.start(ctx, inv.Config)
+	if err != nil {
+		return err
+	}
+	inv.Instance = proc
+	return nil
+}
+
+func (self *LocalRuntime) Invoke(_ context.Context, inv *Invocation) (string, error) {
+	proc, _ := inv.Instance.(*localProcess)
+	if _, err := sendRequest(proc.url(), inv.Request); err != nil {
+		return "", err
+	}
+	return proc.url(), nil
+}
+
+// Await fails the invocation if the process exits before the invocation is over
+func (self *LocalRuntime) Await(inv *Invocation) error {
+	proc, _ := inv.Instance.(*localProcess)
+	select {
+	case <-inv.Done():
+		return nil
+	case <-proc.exited:
+		return fmt.Errorf("service %s exited without sending back its results: %s", proc.name, proc.exitReason())
+	}
+}
+
+func (self *LocalRuntime) Cancel(inv *Invocation) error {
+	proc, _ := inv.Instance.(*localProcess)
+	return proc.stop()
+}
+
+// Teardown stops the process if the invocation failed; otherwise it exits by itself
+func (self *LocalRuntime) Teardown(inv *Invocation, err error) {
+	proc, _ := inv.Instance.(*localProcess)
+	if failed(err) {
+		if err := proc.stop(); err != nil {
+			fmt.Printf("could not stop service %s: %v\n", proc.name, err)
+		}
+	}
+}
+
+// start starts a service for the function described by config, and returns it once it's ready for requests
+func (self *LocalRuntime) start(ctx context.Context, config *PodConfig) (*localProcess, error) {
+	addr, err := freeAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	//nolint:gosec // the path is built by kompile
+	cmd := exec.Command(filepath.Join(self.dir, config.Service, localExeFile))
+	cmd.Env = append(os.Environ(), ListenAddrEnv+"="+addr, CallbackURLEnv+"="+self.callbackURL)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("could not start service %s: %w", config.Name, err)
+	}
+
+	proc := &localProcess{name: config.Name, addr: addr, cmd: cmd, exited: make(chan struct{})}
+	go func() {
+		_ = cmd.Wait() //nolint:errcheck // the exit status ends up in cmd.ProcessState
+		close(proc.exited)
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, self.startTimeout)
+	defer cancel()
+	if err := proc.waitUntilReady(ctx); err != nil {
+		return nil, errors.Join(err, proc.stop())
+	}
+	return proc, nil
+}
+
+// localProcess is a service running as a subprocess; like a pod, it exits by itself once its invocation is over
+type localProcess struct {
+	name string
+	addr string
+	cmd  *exec.Cmd
+
+	// exited is closed once the process has exited
+	exited chan struct{}
+}
+
+func (self *localProcess) url() string {
+	return "http://" + self.addr
+}
+
+func (self *localProcess) stop() error {
+	if err := self.cmd.Process.Signal(syscall.SIGTERM); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return fmt.Errorf("could not stop service %s: %w", self.name, err)
+	}
+	return nil
+}
+
+// waitUntilReady waits for the service to accept connections
+func (self *localProcess) waitUntilReady(ctx context.Context) error {
+	var dialer net.Dialer
+	for {
+		conn, err := dialer.DialContext(ctx, "tcp", self.addr)
+		if err == nil {
+			defer conn.Close()
+			return nil
+		}
+
+		select {
+		case <-self.exited:
+			return fmt.Errorf("service %s exited before it was ready: %s", self.name, self.exitReason())
+		case <-ctx.Done():
+			return fmt.Errorf("gave up waiting for service %s: %w", self.name, ctx.Err())
+		case <-time.After(readyPollInterval):
+		}
+	}
+}
+
+// exitReason describes why the process exited, once it has
+func (self *localProcess) exitReason() string {
+	if self.cmd.ProcessState.ExitCode() == PanicExitCode {
+		return "the offloaded function panicked"
+	}
+	return self.cmd.ProcessState.String()
+}
+
+// freeAddr finds a local port for a service to listen on
+func freeAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("could not find a free port: %w", err)
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
@@ -0,0 +1,123 @@
+package komputil
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// PodUIDEnv is set on the controller, along with PodNameEnv, so that it can find its own pod
+	PodUIDEnv = "POD_UID"
+
+	// ManagedByLabel is set on every pod, Job, and Secret that the controller creates, so that it can find them again
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	managedBy      = "kompile"
+)
+
+// ownedObjectMeta returns the metadata for a pod, Job, or Secret that the controller creates for the offloaded function
+// called name; it's owned by the controller's pod, so that it's deleted along with the controller
+func ownedObjectMeta(namespace, name string) metav1.ObjectMeta {
+	meta := metav1.ObjectMeta{
+		Namespace:    namespace,
+		GenerateName: name + "-",
+		Labels:       map[string]string{ManagedByLabel: managedBy},
+	}
+
+	podName, podUID := os.Getenv(PodNameEnv), os.Getenv(PodUIDEnv)
+	if podName != "" && podUID != "" {
+		meta.OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Name:       podName,
+			UID:        types.UID(podUID),
+		}}
+	}
+	return meta
+}
+
+// CleanUpStale deletes the pods, Jobs, and Secrets left behind by an earlier run of the controller; it's called when
+// the controller starts, before it's started anything of its own.  Anything owned by a controller pod that's gone is
+// garbage-collected by Kubernetes anyway, but that doesn't cover the controller's container restarting in the same pod,
+// or anything started before the controller knew its own pod.
+func CleanUpStale() {
+	clientset, namespace := newClientset()
+	ctx := context.Background()
+	opts := metav1.ListOptions{LabelSelector: ManagedByLabel + "=" + managedBy}
+
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, opts)
+	if err != nil {
+		fmt.Printf("could not list pods: %v\n", err)
+	} else {
+		for _, pod := range pods.Items {
+			if !isStale(ctx, clientset, &pod.ObjectMeta) {
+				continue
+			}
+			fmt.Printf("deleting stale pod %s\n", pod.Name)
+			err := clientset.CoreV1().Pods(namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+			if err != nil && !apierrors.IsNotFound(err) {
+				fmt.Printf("could not delete pod %s: %v\n", pod.Name, err)
+			}
+		}
+	}
+
+	secrets, err := clientset.CoreV1().Secrets(namespace).List(ctx, opts)
+	if err != nil {
+		fmt.Printf("could not list secrets: %v\n", err)
+	} else {
+		for _, secret := range secrets.Items {
+			// Secrets that were handed over to their Job (see JobRuntime) go away along with it
+			ownedByJob := slices.ContainsFunc(secret.OwnerReferences, func(owner metav1.OwnerReference) bool {
+				return owner.Kind == "Job"
+			})
+			if ownedByJob || !isStale(ctx, clientset, &secret.ObjectMeta) {
+				continue
+			}
+			fmt.Printf("deleting stale secret %s\n", secret.Name)
+			if err := deleteSecret(clientset, namespace, secret.Name); err != nil {
+				fmt.Printf("could not delete secret %s: %v\n", secret.Name, err)
+			}
+		}
+	}
+
+	jobs, err := clientset.BatchV1().Jobs(namespace).List(ctx, opts)
+	if err != nil {
+		fmt.Printf("could not list jobs: %v\n", err)
+		return
+	}
+	for _, job := range jobs.Items {
+		if !isStale(ctx, clientset, &job.ObjectMeta) {
+			continue
+		}
+		fmt.Printf("deleting stale job %s\n", job.Name)
+		if err := deleteJob(clientset, namespace, job.Name); err != nil && !apierrors.IsNotFound(err) {
+			fmt.Printf("could not delete job %s: %v\n", job.Name, err)
+		}
+	}
+}
+
+// isStale returns true unless the object is owned by another controller pod that's still running; anything owned by
+// this pod was started before the controller restarted, so nothing is waiting for it any more
+func isStale(ctx context.Context, clientset kubernetes.Interface, meta *metav1.ObjectMeta) bool {
+	for _, owner := range meta.OwnerReferences {
+		if owner.Kind != "Pod" || owner.UID == types.UID(os.Getenv(PodUIDEnv)) {
+			continue
+		}
+
+		pod, err := clientset.CoreV1().Pods(meta.Namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		if err == nil && pod.UID == owner.UID && pod.DeletionTimestamp == nil {
+			return false
+		} else if err != nil && !apierrors.IsNotFound(err) {
+			// If we can't tell, it's safer to leave it alone
+			fmt.Printf("could not fetch pod %s: %v\n", owner.Name, err)
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,210 @@
+package komputil
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// WarmPodsEnv is the number of idle pods that the controller keeps ready for each service, so that invocations
+	// don't have to wait for a new pod to start; if it's zero (the default), every invocation gets a pod of its own
+	WarmPodsEnv = "KOMPILE_WARM_PODS"
+
+	// IdleTimeoutEnv is how long a pod that's left over from a burst of invocations (on top of the warm ones) can sit
+	// idle before it's deleted
+	IdleTimeoutEnv = "KOMPILE_IDLE_TIMEOUT"
+
+	// StartTimeoutEnv is how long the controller waits for a new pod to be ready before the invocation fails
+	StartTimeoutEnv = "KOMPILE_START_TIMEOUT"
+
+	defaultIdleTimeout  = 5 * time.Minute
+	defaultStartTimeout = 2 * time.Minute
+)
+
+// pools holds the pool of pods for each service that's been invoked so far
+//
+//nolint:gochecknoglobals // shared by every invocation in the controller
+var pools sync.Map
+
+// pool hands out pods for a single service.  If it keeps warm pods, it starts that many ahead of time, invocations are
+// dispatched to an idle pod if there is one, and new pods are started in the background to replace the ones that are
+// handed out.  Pods go back to the pool once their invocation is over, so a burst of invocations can leave more idle
+// pods than it needs; those are deleted once they've been idle for the idle timeout.  Without warm pods, every
+// invocation gets a new pod, which exits once it's done.
+type pool struct {
+	config       *PodConfig
+	warmPods     int
+	idleTimeout  time.Duration
+	startTimeout time.Duration
+
+	// starting is the number of pods that are being started for the pool in the background
+	lock     sync.Mutex
+	idle     []*idlePod
+	starting int
+}
+
+type idlePod struct {
+	pod   *Pod
+	timer *time.Timer
+}
+
+func poolFor(config *PodConfig) *pool {
+	if p, ok := pools.Load(config.Name); ok {
+		if self, ok := p.(*pool); ok {
+			return self
+		}
+	}
+
+	p, _ := pools.LoadOrStore(config.Name, newPool(config))
+	self, _ := p.(*pool)
+	return self
+}
+
+func newPool(config *PodConfig) *pool {
+	return &pool{
+		config:       config,
+		warmPods:     intEnv(WarmPodsEnv, 0),
+		idleTimeout:  durationEnv(IdleTimeoutEnv, defaultIdleTimeout),
+		startTimeout: durationEnv(StartTimeoutEnv, defaultStartTimeout),
+	}
+}
+
+// intEnv returns the integer in the environment variable called name, or def if it isn't set (or isn't valid)
+func intEnv(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 0 {
+		fmt.Printf("ignoring invalid %s %q\n", name, value)
+		return def
+	}
+	return i
+}
+
+// durationEnv returns the duration in the environment variable called name, or def if it isn't set (or isn't valid)
+func durationEnv(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		fmt.Printf("ignoring invalid %s %q\n", name, value)
+		return def
+	}
+	return d
+}
+
+// WarmUp starts the warm pods for the service described by config, so that even its first invocation finds a pod
+// that's ready; it doesn't wait for them to start
+func WarmUp(config *PodConfig) {
+	poolFor(config).topUp()
+}
+
+// acquire returns an idle pod, if there is one, or starts a new one; a new pod has to be ready within the pool's start
+// timeout.  Either way, another pod is started in the background to take the place of the one that's handed out.
+func (self *pool) acquire(ctx context.Context) (*Pod, error) {
+	defer self.topUp()
+
+	self.lock.Lock()
+	for len(self.idle) > 0 {
+		last := self.idle[len(self.idle)-1]
+		self.idle = self.idle[:len(self.idle)-1]
+		last.timer.Stop()
+		if !last.pod.Exited() {
+			self.lock.Unlock()
+			return last.pod, nil
+		}
+	}
+	self.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, self.startTimeout)
+	defer cancel()
+	return CreateAndWaitForPod(ctx, self.config, self.warmPods > 0)
+}
+
+// topUp starts enough new pods in the background that the pool has warmPods idle ones once they're ready
+func (self *pool) topUp() {
+	self.lock.Lock()
+	missing := self.warmPods - len(self.idle) - self.starting
+	self.starting += max(missing, 0)
+	self.lock.Unlock()
+
+	for range missing {
+		go self.startIdle()
+	}
+}
+
+// startIdle starts a new pod and adds it to the idle ones
+func (self *pool) startIdle() {
+	ctx, cancel := context.WithTimeout(context.Background(), self.startTimeout)
+	defer cancel()
+	pod, err := CreateAndWaitForPod(ctx, self.config, true)
+
+	self.lock.Lock()
+	self.starting--
+	self.lock.Unlock()
+	if err != nil {
+		fmt.Printf("could not start warm pod for %s: %v\n", self.config.Name, err)
+		return
+	}
+	self.park(pod)
+}
+
+// park adds pod to the idle ones
+func (self *pool) park(pod *Pod) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	timer := time.AfterFunc(self.idleTimeout, func() { self.expire(pod) })
+	self.idle = append(self.idle, &idlePod{pod: pod, timer: timer})
+}
+
+// release is called once the invocation running on pod is over; err is the error that it failed with, if any.  The
+// pod goes back to the pool if it's still healthy, which it is as long as the function returned normally (even if it
+// returned an error); otherwise it's deleted.
+func (self *pool) release(pod *Pod, err error) {
+	if failed(err) || pod.Exited() {
+		self.remove(pod)
+		self.topUp()
+		return
+	} else if self.warmPods == 0 {
+		// The pod exits by itself once it's done
+		return
+	}
+	self.park(pod)
+}
+
+// expire deletes pod if it's still idle and the pool has more idle pods than it needs to keep warm; this is how the
+// pool scales back down once things are quiet
+func (self *pool) expire(pod *Pod) {
+	self.lock.Lock()
+	idx := slices.IndexFunc(self.idle, func(idle *idlePod) bool { return idle.pod == pod })
+	if idx < 0 {
+		self.lock.Unlock()
+		return
+	} else if len(self.idle) <= self.warmPods {
+		self.idle[idx].timer.Reset(self.idleTimeout)
+		self.lock.Unlock()
+		return
+	}
+	self.idle = slices.Delete(self.idle, idx, idx+1)
+	self.lock.Unlock()
+
+	fmt.Printf("deleting idle pod for %s\n", self.config.Name)
+	self.remove(pod)
+}
+
+func (self *pool) remove(pod *Pod) {
+	if err := pod.Delete(); err != nil {
+		fmt.Printf("could not delete pod: %v\n", err)
+	}
+}
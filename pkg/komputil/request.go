@@ -0,0 +1,170 @@
+package komputil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Request is the body that the controller sends to an offloaded service; ID identifies this particular invocation, so
+// that values sent back by the service end up in the right place, and Args holds the (JSON-encoded) receiver, if
+// there is one, followed by each of the arguments to the offloaded function, in the order they're declared.  If the
+// caller's context has a deadline, Timeout is how long the function has left when the request is sent; it's relative,
+// rather than the deadline itself, so that it doesn't matter if the two sides' clocks disagree.
+type Request struct {
+	ID      string            `json:"id"`
+	Args    []json.RawMessage `json:"args,omitempty"`
+	Timeout time.Duration     `json:"timeout,omitempty"`
+}
+
+// Accepted is the service's response to a request; Pod and URL identify the pod that's running the invocation (if the
+// service knows them), so that anything else for the invocation can go straight to that pod, rather than to whichever
+// pod a load-balanced Service picks
+type Accepted struct {
+	Pod string `json:"pod,omitempty"`
+	URL string `json:"url,omitempty"`
+}
+
+const (
+	// CancelPath is where services listen for the controller cancelling an invocation
+	CancelPath = "/kompile/cancel"
+
+	// PodNameEnv and PodIPEnv are set on long-running services, so that they can tell the controller where each
+	// invocation is running; PodNameEnv is also set on the controller (see PodUIDEnv)
+	PodNameEnv = "POD_NAME"
+	PodIPEnv   = "POD_IP"
+)
+
+// invocationCallback is where the controller keeps track of the caller's context and the pod for each invocation;
+// it's not a valid identifier, so that it can't clash with any of the function's channel parameters
+const invocationCallback = "kompile/invocation"
+
+// Invoke starts the invocation with the given ID of the offloaded function described by config on the controller's
+// runtime (see Runtime); it returns the URL that anything else for the invocation is sent to, if there is one, once the
+// invocation has started.  ctx is the caller's context: its deadline is passed along to the service, and if it's done
+// before the function returns, the invocation is cancelled, which cancels the function's context.
+func Invoke(ctx context.Context, id string, config *PodConfig, args ...any) (string, error) {
+	name := config.Name
+	if err := ctx.Err(); err != nil {
+		return "", fmt.Errorf("could not invoke %s: %w", name, err)
+	}
+
+	req, err := encodeRequest(ctx, id, args...)
+	if err != nil {
+		return "", err
+	}
+
+	// The function may well have finished by the time Invoke returns, so the registration has to be in place first
+	rt := currentRuntime
+	inv := newInvocation(id, config, req)
+	callbacks.Store(callbackKey{id, invocationCallback}, &registration{finish: inv.finish})
+
+	if err := rt.Launch(ctx, inv); err != nil {
+		return "", err
+	}
+	url, err := rt.Invoke(ctx, inv)
+	if err != nil {
+		rt.Teardown(inv, err)
+		return "", err
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		select {
+		case <-inv.Done():
+			return
+		default:
+		}
+		fmt.Printf("%s (invocation %s) cancelled: %v\n", name, id, ctx.Err())
+		if err := rt.Cancel(inv); err != nil {
+			fmt.Printf("could not cancel invocation %s: %v\n", id, err)
+		}
+	})
+	go func() {
+		// This doesn't do anything if the invocation's already over
+		if err := rt.Await(inv); err != nil {
+			Fail(id, err)
+		}
+		stop()
+		rt.Teardown(inv, inv.Err())
+	}()
+	return url, nil
+}
+
+// sendRequest sends the encoded request req to the service at serviceURL
+func sendRequest(serviceURL string, req []byte) (*Accepted, error) {
+	fmt.Printf("making request to service: %s\n", serviceURL)
+	resp, err := http.Post(serviceURL, "application/json", bytes.NewReader(req)) //nolint:gosec // url is built by kompile
+	if err != nil {
+		return nil, fmt.Errorf("could not make POST request to service: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("service rejected request: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var accepted Accepted
+	if err := json.NewDecoder(resp.Body).Decode(&accepted); err != nil {
+		return nil, fmt.Errorf("could not read response from service: %w", err)
+	}
+	return &accepted, nil
+}
+
+// RequestFromEnv returns the request that the service was started with, if any (see JobRuntime)
+func RequestFromEnv() (*Request, error) {
+	path := os.Getenv(RequestFileEnv)
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read request: %w", err)
+	}
+	var req Request
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, fmt.Errorf("could not decode request from %s: %w", path, err)
+	}
+	return &req, nil
+}
+
+func encodeRequest(ctx context.Context, id string, args ...any) ([]byte, error) {
+	req := Request{ID: id}
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Timeout = time.Until(deadline)
+	}
+	for i, arg := range args {
+		b, err := json.Marshal(arg)
+		if err != nil {
+			return nil, fmt.Errorf("could not encode argument %d: %w", i, err)
+		}
+		req.Args = append(req.Args, b)
+	}
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode request: %w", err)
+	}
+	return b, nil
+}
+
+// DecodeArgs unmarshals the arguments in the request into the given pointers, in order
+func (self *Request) DecodeArgs(args ...any) error {
+	if len(args) != len(self.Args) {
+		return fmt.Errorf("expected %d arguments, got %d", len(args), len(self.Args))
+	}
+
+	for i, arg := range args {
+		if err := json.Unmarshal(self.Args[i], arg); err != nil {
+			return fmt.Errorf("could not decode argument %d: %w", i, err)
+		}
+	}
+	return nil
+}
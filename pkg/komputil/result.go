@@ -0,0 +1,116 @@
+package komputil
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strings"
+)
+
+// ResultCallback is the callback that a service uses to send the offloaded function's results back to the controller
+// once it returns; it's sent even if the function doesn't return anything, so that the controller knows it's done.
+// It's named after a keyword, so that it can't clash with any of the function's channel parameters.
+const ResultCallback = "return"
+
+// PanicExitCode is the status that a service exits with if the offloaded function panics; it's different from the
+// status of an unrecovered panic (2), so that the controller can tell that the panic was already reported
+const PanicExitCode = 3
+
+// Result holds the values returned by an offloaded function.  Errors don't survive being JSON-encoded, so any error
+// values are sent as their message instead; if the last value is a non-nil error, its message is also put in Err.  If
+// the function panicked, there aren't any values, and Panic and Stack describe what happened instead.
+type Result struct {
+	Values []json.RawMessage
+	Err    string
+	Panic  string
+	Stack  string
+}
+
+// SendResult encodes the function's results and sends them back through cb
+func SendResult(cb *Callback, values ...any) error {
+	result := Result{}
+	for i, value := range values {
+		if err, ok := value.(error); ok {
+			value = err.Error()
+			if i == len(values)-1 {
+				result.Err = err.Error()
+			}
+		}
+
+		b, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("could not encode result %d: %w", i, err)
+		}
+		result.Values = append(result.Values, b)
+	}
+	return cb.Send(result)
+}
+
+// ReturnedError is the error that an invocation fails with if the offloaded function returns an error; unlike the
+// other ways an invocation can fail, this means the service itself is fine
+type ReturnedError struct {
+	Message string
+}
+
+func (self *ReturnedError) Error() string {
+	return self.Message
+}
+
+// RecoverPanic is deferred around the call to the offloaded function in the service; if the function panics, the panic
+// and its stack trace are sent back through cb, and the service exits with PanicExitCode
+func RecoverPanic(cb *Callback) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	stack := debug.Stack()
+	fmt.Printf("panic: %v\n\n%s\n", r, stack)
+	if err := cb.Send(Result{Panic: fmt.Sprint(r), Stack: string(stack)}); err != nil {
+		fmt.Printf("could not report panic: %v\n", err)
+	}
+	os.Exit(PanicExitCode)
+}
+
+// RegisterResult waits for the results of the invocation with the given ID of the offloaded function called name; a
+// go statement throws its function's results away, so all we can do is log them.  Once the results arrive the function
+// has finished, and nothing else will be sent back for this invocation, so all of its registrations are removed; if it
+// returned an error, the invocation fails with a ReturnedError, which leaves the caller's channels open.
+func RegisterResult(id, name string) {
+	callbacks.Store(callbackKey{id, ResultCallback}, &registration{
+		deliver: func(data []byte, _ bool) error {
+			var result Result
+			if err := json.Unmarshal(data, &result); err != nil {
+				err = fmt.Errorf("could not decode result: %w", err)
+				finishInvocation(id, err)
+				return err
+			}
+
+			if result.Panic != "" {
+				finishInvocation(id, fmt.Errorf("panic: %s\n\n%s", result.Panic, result.Stack))
+				return nil
+			} else if result.Err != "" {
+				finishInvocation(id, &ReturnedError{result.Err})
+				return nil
+			}
+
+			if len(result.Values) > 0 {
+				values := make([]string, 0, len(result.Values))
+				for _, value := range result.Values {
+					values = append(values, string(value))
+				}
+				fmt.Printf("%s (invocation %s) returned %s\n", name, id, strings.Join(values, ", "))
+			} else {
+				fmt.Printf("%s (invocation %s) finished\n", name, id)
+			}
+			finishInvocation(id, nil)
+			return nil
+		},
+		finish: func(err error) {
+			if err != nil {
+				fmt.Printf("%s (invocation %s) failed: %v\n", name, id, err)
+			}
+		},
+	})
+}
@@ -0,0 +1,141 @@
+package komputil
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Runtime runs the services that offloaded functions run in; the controller picks one with UseRuntime when it starts,
+// depending on how it was compiled.  Invoke takes every invocation through the same steps: Launch, then Invoke, then
+// Await in the background, and finally Teardown, once the invocation is over.  If the caller's context is done before
+// then, Cancel stops the invocation early.
+type Runtime interface {
+	// Launch gets a service ready to run inv (e.g. by starting a pod or a process), and sets inv.Instance to whatever
+	// the other steps need to find it again
+	Launch(ctx context.Context, inv *Invocation) error
+
+	// Invoke sends inv its request; it returns the URL that anything else for the invocation (like the values for its
+	// inbound channels) is sent to, if there is one
+	Invoke(ctx context.Context, inv *Invocation) (string, error)
+
+	// Await watches the service running inv until the invocation is over, in which case it returns nil; if the service
+	// goes away before it sends back its results, Await returns why, and the invocation fails with that error
+	Await(inv *Invocation) error
+
+	// Cancel stops inv before it's over, which cancels the function's context
+	Cancel(inv *Invocation) error
+
+	// Teardown cleans up after inv once it's over, or once Invoke fails; err is the error that it failed with, if any
+	Teardown(inv *Invocation, err error)
+}
+
+// Invocation is a single call to an offloaded function: ID identifies it, Config describes the function's service,
+// and Request is the encoded request for the service; Instance is whatever the runtime launched to run it.  It's over
+// once the function's results arrive, or once it fails.
+type Invocation struct {
+	ID       string
+	Config   *PodConfig
+	Request  []byte
+	Instance any
+
+	lock sync.Mutex
+	done chan struct{}
+	err  error
+}
+
+//nolint:gochecknoglobals // set once when the controller starts
+var currentRuntime Runtime = &PodRuntime{}
+
+// UseRuntime makes the controller run services on rt; it has to be called before anything is offloaded
+func UseRuntime(rt Runtime) {
+	currentRuntime = rt
+}
+
+func newInvocation(id string, config *PodConfig, req []byte) *Invocation {
+	return &Invocation{ID: id, Config: config, Request: req, done: make(chan struct{})}
+}
+
+// Done is closed once the invocation is over
+func (self *Invocation) Done() <-chan struct{} {
+	return self.done
+}
+
+// Err returns the error that the invocation failed with once it's over, or nil if it succeeded (or isn't over yet)
+func (self *Invocation) Err() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.err
+}
+
+// context returns a context that's cancelled once the invocation is over, for watching its service
+func (self *Invocation) context() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-self.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func (self *Invocation) finish(err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	select {
+	case <-self.done:
+	default:
+		self.err = err
+		close(self.done)
+	}
+}
+
+// PodRuntime runs each invocation in a pod of its own in the controller's namespace, which comes from the service's
+// pool of warm pods if it has one (see pool)
+type PodRuntime struct{}
+
+func (self *PodRuntime) Launch(ctx context.Context, inv *Invocation) error {
+	pod, err := poolFor(inv.Config).acquire(ctx)
+	if err != nil {
+		return err
+	}
+	inv.Instance = pod
+	return nil
+}
+
+func (self *PodRuntime) Invoke(_ context.Context, inv *Invocation) (string, error) {
+	pod, _ := inv.Instance.(*Pod)
+	if _, err := sendRequest(pod.URL, inv.Request); err != nil {
+		return "", err
+	}
+	return pod.URL, nil
+}
+
+func (self *PodRuntime) Await(inv *Invocation) error {
+	pod, _ := inv.Instance.(*Pod)
+	select {
+	case <-inv.Done():
+		return nil
+	case <-pod.done:
+		return pod.err
+	}
+}
+
+func (self *PodRuntime) Cancel(inv *Invocation) error {
+	pod, _ := inv.Instance.(*Pod)
+	return pod.Delete()
+}
+
+func (self *PodRuntime) Teardown(inv *Invocation, err error) {
+	pod, _ := inv.Instance.(*Pod)
+	poolFor(inv.Config).release(pod, err)
+}
+
+// failed returns true if err means that the service running an invocation can't be trusted anymore; an offloaded
+// function returning an error doesn't count
+func failed(err error) bool {
+	var returned *ReturnedError
+	return err != nil && !errors.As(err, &returned)
+}
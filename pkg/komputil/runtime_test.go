@@ -0,0 +1,180 @@
+package komputil
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRuntime records the steps that each invocation goes through; launchErr and invokeErr make those steps fail, and
+// sending on died makes the service go away
+type fakeRuntime struct {
+	launchErr error
+	invokeErr error
+	died      chan error
+
+	lock     sync.Mutex
+	steps    []string
+	torndown chan error
+}
+
+func newFakeRuntime() *fakeRuntime {
+	return &fakeRuntime{died: make(chan error, 1), torndown: make(chan error, 1)}
+}
+
+func (self *fakeRuntime) step(name string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.steps = append(self.steps, name)
+}
+
+func (self *fakeRuntime) Launch(context.Context, *Invocation) error {
+	self.step("launch")
+	return self.launchErr
+}
+
+func (self *fakeRuntime) Invoke(context.Context, *Invocation) (string, error) {
+	self.step("invoke")
+	return "http://service", self.invokeErr
+}
+
+func (self *fakeRuntime) Await(inv *Invocation) error {
+	self.step("await")
+	select {
+	case <-inv.Done():
+		return nil
+	case err := <-self.died:
+		return err
+	}
+}
+
+func (self *fakeRuntime) Cancel(*Invocation) error {
+	self.step("cancel")
+	return nil
+}
+
+func (self *fakeRuntime) Teardown(_ *Invocation, err error) {
+	self.step("teardown")
+	self.torndown <- err
+}
+
+func TestInvoke(t *testing.T) {
+	died := errors.New("service died")
+	for name, tc := range map[string]struct {
+		finish func(rt *fakeRuntime, id string, cancel context.CancelFunc)
+		steps  []string
+		err    error
+	}{
+		"returned": {
+			finish: func(_ *fakeRuntime, id string, _ context.CancelFunc) { finishInvocation(id, nil) },
+			steps:  []string{"launch", "invoke", "await", "teardown"},
+		},
+		"returned an error": {
+			finish: func(_ *fakeRuntime, id string, _ context.CancelFunc) {
+				finishInvocation(id, &ReturnedError{"oops"})
+			},
+			steps: []string{"launch", "invoke", "await", "teardown"},
+			err:   &ReturnedError{"oops"},
+		},
+		"service died": {
+			finish: func(rt *fakeRuntime, _ string, _ context.CancelFunc) { rt.died <- died },
+			steps:  []string{"launch", "invoke", "await", "teardown"},
+			err:    died,
+		},
+		"cancelled": {
+			finish: func(_ *fakeRuntime, id string, cancel context.CancelFunc) {
+				cancel()
+				time.Sleep(50 * time.Millisecond)
+				finishInvocation(id, nil)
+			},
+			steps: []string{"launch", "invoke", "await", "cancel", "teardown"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rt := newFakeRuntime()
+			UseRuntime(rt)
+			defer UseRuntime(&PodRuntime{})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			id := NewInvocationID()
+			url, err := Invoke(ctx, id, &PodConfig{Name: "fake"}, 1)
+			if err != nil {
+				t.Fatal(err)
+			} else if url != "http://service" {
+				t.Errorf("expected http://service, got %s", url)
+			}
+
+			// Give Await the chance to start before the invocation is over
+			time.Sleep(10 * time.Millisecond)
+			tc.finish(rt, id, cancel)
+			select {
+			case err := <-rt.torndown:
+				if !reflect.DeepEqual(err, tc.err) {
+					t.Errorf("expected teardown with %v, got %v", tc.err, err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("invocation was never torn down")
+			}
+
+			rt.lock.Lock()
+			defer rt.lock.Unlock()
+			if !reflect.DeepEqual(rt.steps, tc.steps) {
+				t.Errorf("expected steps %v, got %v", tc.steps, rt.steps)
+			}
+		})
+	}
+}
+
+func TestInvokeFails(t *testing.T) {
+	failure := errors.New("oops")
+	for name, tc := range map[string]struct {
+		launchErr error
+		invokeErr error
+		steps     []string
+	}{
+		"launch fails": {launchErr: failure, steps: []string{"launch"}},
+		"invoke fails": {invokeErr: failure, steps: []string{"launch", "invoke", "teardown"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rt := newFakeRuntime()
+			rt.launchErr, rt.invokeErr = tc.launchErr, tc.invokeErr
+			UseRuntime(rt)
+			defer UseRuntime(&PodRuntime{})
+
+			id := NewInvocationID()
+			if _, err := Invoke(context.Background(), id, &PodConfig{Name: "fake"}, 1); !errors.Is(err, failure) {
+				t.Fatalf("expected %v, got %v", failure, err)
+			}
+			Fail(id, failure)
+
+			if tc.invokeErr != nil {
+				if err := <-rt.torndown; !errors.Is(err, failure) {
+					t.Errorf("expected teardown with %v, got %v", failure, err)
+				}
+			}
+			if !reflect.DeepEqual(rt.steps, tc.steps) {
+				t.Errorf("expected steps %v, got %v", tc.steps, rt.steps)
+			}
+		})
+	}
+}
+
+func TestInvocationErr(t *testing.T) {
+	inv := newInvocation(NewInvocationID(), &PodConfig{}, nil)
+	failure := errors.New("pod died")
+	inv.finish(failure)
+	inv.finish(nil)
+
+	select {
+	case <-inv.Done():
+	default:
+		t.Fatal("invocation not done")
+	}
+	if err := inv.Err(); !errors.Is(err, failure) {
+		t.Errorf("expected %v, got %v", failure, err)
+	}
+}
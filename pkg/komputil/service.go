@@ -0,0 +1,173 @@
+package komputil
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// WorkerEnv is set on pods that belong to a pool of warm workers; those keep serving invocations until they're
+	// deleted, instead of exiting after the first one
+	WorkerEnv = "KOMPILE_WORKER"
+
+	// shutdownTimeout is how long a service waits for requests that are still in flight (like values sent to its
+	// inbound channels) once it's done
+	shutdownTimeout = 10 * time.Second
+
+	readHeaderTimeout = 10 * time.Second
+)
+
+// Service runs the HTTP server for an offloaded function.  It keeps running until the function is finished (or, for
+// a worker, forever), or until the pod is asked to stop; in that case the function's context is cancelled, and the
+// service waits for any running invocations to return, so that their deferred cleanup runs and their results are
+// sent back.
+type Service struct {
+	server *http.Server
+	worker bool
+
+	running    sync.WaitGroup
+	finished   chan struct{}
+	finishOnce sync.Once
+
+	// cancels holds the cancel function for the context of every running invocation; once the service is stopping,
+	// any new invocation's context is cancelled straight away
+	lock     sync.Mutex
+	cancels  map[string]context.CancelFunc
+	stopping bool
+}
+
+// NewService returns a service that listens on addr, unless ListenAddrEnv says otherwise
+func NewService(addr string) *Service {
+	if override := os.Getenv(ListenAddrEnv); override != "" {
+		addr = override
+	}
+
+	return &Service{
+		server:   &http.Server{Addr: addr, ReadHeaderTimeout: readHeaderTimeout},
+		worker:   os.Getenv(WorkerEnv) != "",
+		finished: make(chan struct{}),
+		cancels:  map[string]context.CancelFunc{},
+	}
+}
+
+// Context returns the context for the invocation in req, which is passed to offloaded functions that take a context;
+// it's cancelled when the pod is asked to stop, when the controller cancels the invocation (see HandleCancel), or when
+// the caller's deadline passes
+func (self *Service) Context(req *Request) context.Context {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if req.Timeout == 0 {
+		ctx, cancel = context.WithCancel(context.Background())
+	} else {
+		ctx, cancel = context.WithTimeout(context.Background(), req.Timeout)
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.stopping {
+		cancel()
+	}
+	self.cancels[req.ID] = cancel
+	return ctx
+}
+
+// Start is called once the service has accepted an invocation; the service doesn't shut down until the invocation
+// calls Finish
+func (self *Service) Start() {
+	self.running.Add(1)
+}
+
+// Accept tells the controller that the service has accepted an invocation, and which pod it's running on
+func (self *Service) Accept(w http.ResponseWriter) {
+	accepted := Accepted{Pod: os.Getenv(PodNameEnv)}
+	if ip := os.Getenv(PodIPEnv); ip != "" {
+		accepted.URL = fmt.Sprintf("http://%s:8080", ip)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(accepted); err != nil {
+		fmt.Printf("could not send response: %v\n", err)
+	}
+}
+
+// Finish is called once the offloaded function for the invocation in req has returned, and everything it produced
+// has been sent back; unless this is a worker, the service is done after that.  The function won't read from its
+// inbound channels anymore, so they're let go of as well; otherwise a value that the controller sends after the
+// function returned would be stuck waiting for somebody to receive it.
+func (self *Service) Finish(req *Request) {
+	finishInvocation(req.ID, nil)
+
+	self.lock.Lock()
+	if cancel, ok := self.cancels[req.ID]; ok {
+		cancel()
+		delete(self.cancels, req.ID)
+	}
+	self.lock.Unlock()
+
+	self.running.Done()
+	if !self.worker {
+		self.finishOnce.Do(func() { close(self.finished) })
+	}
+}
+
+// HandleCancel is the handler for the controller cancelling an invocation; it cancels the invocation's context
+func (self *Service) HandleCancel(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	fmt.Printf("cancelling invocation %s\n", id)
+
+	self.lock.Lock()
+	cancel, ok := self.cancels[id]
+	self.lock.Unlock()
+	if ok {
+		cancel()
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Run serves requests until the service is finished or asked to stop, and then shuts the server down cleanly
+func (self *Service) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	defer self.cancelAll()
+
+	errs := make(chan error, 1)
+	go func() { errs <- self.server.ListenAndServe() }()
+
+	select {
+	case err := <-errs:
+		return fmt.Errorf("could not serve: %w", err)
+	case <-self.finished:
+	case <-ctx.Done():
+		fmt.Println("received shutdown signal")
+		self.cancelAll()
+		self.running.Wait()
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := self.server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("could not shut down server: %w", err)
+	}
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("could not serve: %w", err)
+	}
+	return nil
+}
+
+// cancelAll cancels the context of every running invocation, and of any that arrive from now on
+func (self *Service) cancelAll() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.stopping = true
+	for _, cancel := range self.cancels {
+		cancel()
+	}
+}
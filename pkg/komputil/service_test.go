@@ -0,0 +1,37 @@
+package komputil
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServiceFinishReleasesInbound(t *testing.T) {
+	service := NewService(":0")
+	req := &Request{ID: NewInvocationID()}
+	RegisterChannel(req.ID, "in", make(chan int))
+	service.Start()
+
+	// Nobody ever reads from the channel, so this blocks until the invocation is finished
+	codes := make(chan int)
+	go func() { codes <- deliver(t, req.ID, "in", "1") }()
+	select {
+	case code := <-codes:
+		t.Fatalf("value delivered to a channel that nobody reads from: %d", code)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	service.Finish(req)
+	select {
+	case code := <-codes:
+		if code != http.StatusOK {
+			t.Errorf("expected %d, got %d", http.StatusOK, code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("delivery still blocked after the invocation finished")
+	}
+
+	if code := deliver(t, req.ID, "in", "2"); code != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, code)
+	}
+}
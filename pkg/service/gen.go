@@ -4,13 +4,16 @@ import (
 	"bytes"
 	"fmt"
 	"go/ast"
+	"go/format"
+	"go/parser"
 	"go/printer"
 	"go/token"
 	"log"
+	"maps"
 	"os"
+	"strings"
 	"text/template"
 
-	"github.com/go-toolsmith/astcopy"
 	"github.com/samber/lo"
 
 	"github.com/acrlabs/kompile/pkg/util"
@@ -21,150 +24,189 @@ import (
 //go:embed embeds/server.go.tmpl
 var serverTemplate string
 
-// Struct to hold the function declaration and its name
+//go:embed embeds/deployment.yml.tmpl
+var deploymentYamlTemplate string
+
+// Struct to hold the function declaration and everything needed to call it
 type ServerConfig struct {
 	FunctionDeclaration string
 	FunctionName        string
-}
 
-func PrintFullFuncDecl(funcDecl *ast.FuncDecl, args []*ast.Field, fset *token.FileSet) string {
-	var buf bytes.Buffer
-	newFuncDecl := astcopy.FuncDecl(funcDecl)
+	// Module is the path of the service's own module; it lives under the source module's path, so that the service
+	// can still import the source module's internal packages
+	Module string
 
-	// Look for "channel" arguments; these are interpreted as returns
-	newFuncDecl.Type.Params.List = args
+	// Imports are the packages that FunctionDeclaration refers to; the packages used by the template itself are
+	// added automatically
+	Imports []util.Import
 
-	// "return" statements in the body should be discard, and channel sends should be converted to HTTP callbacks
-	newBody := stripReturns(funcDecl.Body)
-	convertChannelSendToHTTPPost(funcDecl.Name.Name, newBody)
+	// Function is the name of the function (or method, if Receiver is set) to call; Receiver is the type of the
+	// receiver that's decoded from the request, and Params describes each of the function's parameters.  If Variadic
+	// is set, the last argument is a slice that's passed with ...
+	Function string
+	Receiver string
+	Params   []Param
+	Variadic bool
 
-	newFuncDecl.Body = newBody
+	// Results has an entry for each of the function's results, which is set if that result can be sent back to the
+	// controller once the function returns
+	Results []bool
 
-	err := printer.Fprint(&buf, fset, newFuncDecl)
-	if err != nil {
-		log.Printf("Failed to print function declaration: %v", err)
+	// CallbackURL is where the service sends values back to the controller
+	CallbackURL string
+}
+
+// Param is a parameter of the offloaded function of the given Type; it's either a value that's decoded from the
+// request, or (if Callback is set) a channel whose values are forwarded back to the caller through that callback.
+// Inbound channels go the other way: the caller sends values to the service through the callback.  If Context is set,
+// the parameter is a context.Context, and the function gets a context that follows the caller's (see Service.Context).
+type Param struct {
+	Type     string
+	Callback string
+	Inbound  bool
+	Context  bool
+}
+
+// HasInbound returns true if the service receives values from the controller on any of its channels
+func (self *ServerConfig) HasInbound() bool {
+	return lo.SomeBy(self.Params, func(p Param) bool { return p.Inbound })
+}
+
+// ResultVars returns the left-hand side of the assignment that captures the function's results, or nothing if there
+// aren't any to capture
+func (self *ServerConfig) ResultVars() string {
+	if !lo.Contains(self.Results, true) {
 		return ""
 	}
-	return buf.String()
+	return strings.Join(lo.Map(self.Results, func(send bool, i int) string {
+		return lo.Ternary(send, fmt.Sprintf("result%d", i), "_")
+	}), ", ") + " := "
+}
+
+// ResultArgs returns the values that are sent back to the controller for each of the function's results; anything that
+// can't be sent is left as nil
+func (self *ServerConfig) ResultArgs() []string {
+	return lo.Map(self.Results, func(send bool, i int) string {
+		return lo.Ternary(send, fmt.Sprintf("result%d", i), "nil")
+	})
 }
 
-// Function to generate the Go source file
-func GenerateMain(funcName, functionDecl, outputDir string) error {
-	// Create the server configuration
-	config := ServerConfig{
-		FunctionDeclaration: functionDecl,
-		FunctionName:        funcName,
+// PrintDecls prints out the offloaded function, along with any supporting declarations that it needs
+func PrintDecls(decls []ast.Decl, fset *token.FileSet) string {
+	var buf bytes.Buffer
+	for _, decl := range decls {
+		if err := printer.Fprint(&buf, fset, decl); err != nil {
+			log.Printf("Failed to print declaration: %v", err)
+			return ""
+		}
+		buf.WriteString("\n\n")
 	}
+	return buf.String()
+}
 
+// Function to generate the Go source file; the service is its own module, built with the requirements in goMod
+func GenerateMain(config *ServerConfig, outputDir string, goMod *util.GoMod) error {
+	funcName := config.FunctionName
 	serverOutputDir := fmt.Sprintf("%s/%s", outputDir, funcName)
 	os.RemoveAll(serverOutputDir)
 	if err := os.MkdirAll(serverOutputDir, os.ModePerm); err != nil {
 		return fmt.Errorf("could not create directory: %w", err)
 	}
 
-	// Create the output file
-	outfile := fmt.Sprintf("%s/%s", serverOutputDir, util.MainGoFile)
-	file, err := os.Create(outfile)
-	if err != nil {
-		return fmt.Errorf("could not create file: %w", err)
-	}
-	defer file.Close()
-
 	// Parse and execute the template
 	tmpl, err := template.New("server").Parse(serverTemplate)
 	if err != nil {
 		return fmt.Errorf("could not parse template: %w", err)
 	}
 
-	if err := tmpl.Execute(file, config); err != nil {
+	var src bytes.Buffer
+	config.CallbackURL = fmt.Sprintf("http://%s:8080", util.ControllerName)
+	if err := tmpl.Execute(&src, config); err != nil {
 		return fmt.Errorf("could not execute template: %w", err)
 	}
 
-	if err := util.GenerateImports(outfile); err != nil {
-		return fmt.Errorf("could not generate imports: %w", err)
+	// Parse the generated code back in so that we can add all of the imports it needs
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, util.MainGoFile, src.Bytes(), parser.ParseComments)
+	if err != nil {
+		return fmt.Errorf("could not parse generated code: %w", err)
+	}
+	util.AddImports(fset, file, templateImports())
+	util.AddImports(fset, file, config.Imports)
+
+	// Create the output file
+	outfile := fmt.Sprintf("%s/%s", serverOutputDir, util.MainGoFile)
+	out, err := os.Create(outfile)
+	if err != nil {
+		return fmt.Errorf("could not create file: %w", err)
+	}
+	defer out.Close()
+
+	if err := format.Node(out, fset, file); err != nil {
+		return fmt.Errorf("could not write file: %w", err)
 	}
 
-	if err := util.InitGoMod(funcName, serverOutputDir); err != nil {
+	if err := goMod.Write(config.Module, serverOutputDir); err != nil {
 		return fmt.Errorf("could not set up go.mod: %w", err)
 	}
 
 	return nil
 }
 
-func stripReturns(block *ast.BlockStmt) *ast.BlockStmt {
-	stmts := lo.FilterMap(block.List, func(stmt ast.Stmt, _ int) (ast.Stmt, bool) {
-		switch s := stmt.(type) {
-		case *ast.ReturnStmt:
-			return nil, false
-		case *ast.IfStmt:
-			newIf := astcopy.IfStmt(s)
-			newIf.Body = stripReturns(s.Body)
-			return newIf, true
-		default:
-			return stmt, true
-		}
-	})
-
-	return &ast.BlockStmt{List: stmts}
+// DeploymentConfig describes the Kubernetes resources for a service that runs as a Deployment (see
+// controller.DeploymentRuntime); if MaxReplicas is set, the Deployment is scaled up to that many replicas based on its
+// CPU usage
+type DeploymentConfig struct {
+	Name         string
+	Image        string
+	Requests     map[string]string
+	Volumes      []util.Volume
+	NodeSelector map[string]string
+	MaxReplicas  int
 }
 
-func convertChannelSendToHTTPPost(name string, block *ast.BlockStmt) {
-	for i, stmt := range block.List {
-		if send, ok := stmt.(*ast.SendStmt); ok {
-			chName := send.Chan.(*ast.Ident).Name
-			block.List[i] = &ast.IfStmt{
-				Init: &ast.AssignStmt{
-					Lhs: []ast.Expr{
-						&ast.Ident{Name: "_"},
-						&ast.Ident{Name: "err"},
-					},
-					Tok: token.DEFINE,
-					Rhs: []ast.Expr{&ast.CallExpr{
-						Fun: &ast.Ident{Name: "http.Post"},
-						Args: []ast.Expr{
-							&ast.BasicLit{
-								Value: fmt.Sprintf("\"http://%s:8080/%s_%s\"", util.ControllerName, name, chName),
-								Kind:  token.STRING,
-							},
-							&ast.BasicLit{
-								Value: "\"application/text\"",
-								Kind:  token.STRING,
-							},
-							sendStmtToIoReader(send),
-						},
-					}},
-				},
-				Cond: &ast.BinaryExpr{
-					X:  &ast.Ident{Name: "err"},
-					Op: token.NEQ,
-					Y:  &ast.Ident{Name: "nil"},
-				},
-				Body: &ast.BlockStmt{
-					List: []ast.Stmt{
-						&ast.ExprStmt{
-							X: util.FmtPrintExpr("Printf", "could not send return value: %v\\n", "err"),
-						},
-					},
-				},
-			}
-		}
+// defaultCPURequest is the CPU request for autoscaled services that don't ask for anything else; the autoscaler
+// can't measure utilization without one
+const defaultCPURequest = "100m"
+
+// WriteYaml writes out the manifest for the Deployment and Service (and autoscaler, if any) of the service called
+// funcName, whose pods are configured by pod
+func WriteYaml(funcName, outputDir, dockerRegistry string, pod *util.PodConfig, maxReplicas int) error {
+	config := DeploymentConfig{
+		Name:         util.ResourceName(funcName),
+		Image:        strings.ToLower(fmt.Sprintf("%s/%s:latest", dockerRegistry, funcName)),
+		Requests:     maps.Clone(pod.Resources),
+		Volumes:      pod.Volumes,
+		NodeSelector: pod.NodeSelector,
+		MaxReplicas:  maxReplicas,
+	}
+	if _, ok := config.Requests["cpu"]; maxReplicas > 0 && !ok {
+		config.Requests["cpu"] = defaultCPURequest
+	}
+	f, err := os.Create(fmt.Sprintf("%s/%s/deployment.yml", outputDir, funcName))
+	if err != nil {
+		return fmt.Errorf("could not create service k8s manifest: %w", err)
+	}
+	defer f.Close()
+
+	tmpl, err := template.New("deploymentYml").Parse(deploymentYamlTemplate)
+	if err != nil {
+		return fmt.Errorf("could not parse template: %w", err)
+	}
+
+	if err := tmpl.Execute(f, config); err != nil {
+		return fmt.Errorf("could not execute template: %w", err)
 	}
+	return nil
 }
 
-func sendStmtToIoReader(send *ast.SendStmt) ast.Expr {
-	return &ast.CallExpr{
-		Fun: &ast.Ident{Name: "strings.NewReader"},
-		Args: []ast.Expr{
-			&ast.CallExpr{
-				Fun: &ast.Ident{Name: "fmt.Sprintf"},
-				Args: []ast.Expr{
-					&ast.BasicLit{
-						Value: "\"%v\"",
-						Kind:  token.STRING,
-					},
-					send.Value,
-				},
-			},
-		},
+// templateImports are the packages used by the server template
+func templateImports() []util.Import {
+	return []util.Import{
+		{Path: "encoding/json"},
+		{Path: "fmt"},
+		{Path: "log"},
+		{Path: "net/http"},
+		{Path: util.KomputilPackage},
 	}
 }
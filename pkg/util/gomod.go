@@ -0,0 +1,194 @@
+package util
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"go/version"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/samber/lo"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+const (
+	KompileModule = "github.com/acrlabs/kompile"
+
+	// KompileDir is where the generated modules find the copy of kompile that they're built against, relative to
+	// the module directory; this assumes that the output directory lives at the top level of the kompile repo
+	KompileDir = "../../"
+
+	// unversioned is the placeholder version that the go command uses for modules that are only found via a replace
+	unversioned = "v0.0.0-00010101000000-000000000000"
+)
+
+// GoMod holds the requirements, replacements, and checksums that the generated modules are built with; it starts
+// out as a copy of the source module's go.mod and go.sum, so that the generated code builds with exactly the same
+// dependencies as the original program, and without having to resolve anything over the network
+type GoMod struct {
+	goVersion string
+	toolchain string
+	requires  map[string]*modfile.Require
+	replaces  map[module.Version]module.Version
+	sums      map[string]bool
+}
+
+// LoadGoMod reads the go.mod and go.sum (if there is one) from dir; any replace directives that point at a relative
+// path are made absolute, so that they still work when copied into a module somewhere else
+func LoadGoMod(dir string) (*GoMod, error) {
+	path := filepath.Join(dir, "go.mod")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read go.mod: %w", err)
+	}
+
+	file, err := modfile.Parse(path, data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse go.mod: %w", err)
+	}
+
+	self := &GoMod{
+		requires: map[string]*modfile.Require{},
+		replaces: map[module.Version]module.Version{},
+		sums:     map[string]bool{},
+	}
+	if file.Go != nil {
+		self.goVersion = file.Go.Version
+	}
+	if file.Toolchain != nil {
+		self.toolchain = file.Toolchain.Name
+	}
+	for _, req := range file.Require {
+		self.requires[req.Mod.Path] = &modfile.Require{Mod: req.Mod, Indirect: req.Indirect}
+	}
+	for _, rep := range file.Replace {
+		newMod := rep.New
+		if modfile.IsDirectoryPath(newMod.Path) && !filepath.IsAbs(newMod.Path) {
+			newMod.Path = filepath.Join(dir, newMod.Path)
+		}
+		self.replaces[rep.Old] = newMod
+	}
+
+	if err := self.loadSums(filepath.Join(dir, "go.sum")); err != nil {
+		return nil, err
+	}
+	return self, nil
+}
+
+func (self *GoMod) loadSums(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		// not every module has a go.sum
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not open go.sum: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			self.sums[line] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("could not read go.sum: %w", err)
+	}
+	return nil
+}
+
+// Merge adds everything from other into this module; if both modules require the same dependency, the higher of the
+// two versions wins, which is the same choice that the go command would make
+func (self *GoMod) Merge(other *GoMod) {
+	if version.Compare("go"+other.goVersion, "go"+self.goVersion) > 0 {
+		self.goVersion = other.goVersion
+	}
+	if version.Compare(other.toolchain, self.toolchain) > 0 {
+		self.toolchain = other.toolchain
+	}
+
+	for path, req := range other.requires {
+		existing, ok := self.requires[path]
+		if !ok {
+			self.requires[path] = &modfile.Require{Mod: req.Mod, Indirect: req.Indirect}
+			continue
+		}
+		if semver.Compare(req.Mod.Version, existing.Mod.Version) > 0 {
+			existing.Mod.Version = req.Mod.Version
+		}
+		existing.Indirect = existing.Indirect && req.Indirect
+	}
+
+	for old, rep := range other.replaces {
+		if _, ok := self.replaces[old]; !ok {
+			self.replaces[old] = rep
+		}
+	}
+
+	for line := range other.sums {
+		self.sums[line] = true
+	}
+}
+
+// AddLocal requires the module at path and points it at the local directory dir
+func (self *GoMod) AddLocal(path, dir string) {
+	self.requires[path] = &modfile.Require{Mod: module.Version{Path: path, Version: unversioned}}
+	self.replaces[module.Version{Path: path}] = module.Version{Path: dir}
+}
+
+// Write creates go.mod and go.sum for the module called name in outputDir; any requirement on the module itself is
+// skipped, since a module can't depend on itself
+func (self *GoMod) Write(name, outputDir string) error {
+	file := &modfile.File{}
+	if err := file.AddModuleStmt(name); err != nil {
+		return fmt.Errorf("could not add module statement: %w", err)
+	}
+	if self.goVersion != "" {
+		if err := file.AddGoStmt(self.goVersion); err != nil {
+			return fmt.Errorf("could not add go statement: %w", err)
+		}
+	}
+	if self.toolchain != "" {
+		if err := file.AddToolchainStmt(self.toolchain); err != nil {
+			return fmt.Errorf("could not add toolchain statement: %w", err)
+		}
+	}
+
+	requires := lo.Filter(lo.Values(self.requires), func(req *modfile.Require, _ int) bool {
+		return req.Mod.Path != name
+	})
+	slices.SortFunc(requires, func(a, b *modfile.Require) int { return strings.Compare(a.Mod.Path, b.Mod.Path) })
+	file.SetRequireSeparateIndirect(requires)
+
+	replaced := lo.Filter(lo.Keys(self.replaces), func(old module.Version, _ int) bool { return old.Path != name })
+	slices.SortFunc(replaced, func(a, b module.Version) int { return strings.Compare(a.String(), b.String()) })
+	for _, old := range replaced {
+		rep := self.replaces[old]
+		if err := file.AddReplace(old.Path, old.Version, rep.Path, rep.Version); err != nil {
+			return fmt.Errorf("could not add replace for %s: %w", old.Path, err)
+		}
+	}
+	file.Cleanup()
+
+	data, err := file.Format()
+	if err != nil {
+		return fmt.Errorf("could not format go.mod: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(outputDir, "go.mod"), data, 0o600); err != nil {
+		return fmt.Errorf("could not write go.mod: %w", err)
+	}
+
+	sums := lo.Keys(self.sums)
+	slices.Sort(sums)
+	sumData := strings.Join(sums, "\n") + "\n"
+	if err := os.WriteFile(filepath.Join(outputDir, "go.sum"), []byte(sumData), 0o600); err != nil {
+		return fmt.Errorf("could not write go.sum: %w", err)
+	}
+	return nil
+}
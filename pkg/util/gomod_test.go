@@ -0,0 +1,194 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/mod/module"
+)
+
+// loadGoMod writes goMod (and goSum, if it's set) to a new directory and loads them back
+func loadGoMod(t *testing.T, goMod, goSum string) *GoMod {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte(goMod), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if goSum != "" {
+		if err := os.WriteFile(filepath.Join(dir, "go.sum"), []byte(goSum), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	self, err := LoadGoMod(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return self
+}
+
+// writeGoMod writes self out as the module called name, and returns the contents of go.mod and go.sum
+func writeGoMod(t *testing.T, self *GoMod, name string) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := self.Write(name, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	goMod, err := os.ReadFile(filepath.Join(dir, "go.mod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	goSum, err := os.ReadFile(filepath.Join(dir, "go.sum"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(goMod), string(goSum)
+}
+
+func TestGoModMerge(t *testing.T) {
+	for name, tc := range map[string]struct {
+		base     string
+		other    string
+		expected string
+	}{
+		"newer go version wins": {
+			base:  "module a\n\ngo 1.21\n",
+			other: "module b\n\ngo 1.22.3\n",
+			expected: `module out
+
+go 1.22.3
+`,
+		},
+		"older go version loses": {
+			base:  "module a\n\ngo 1.22.3\ntoolchain go1.22.5\n",
+			other: "module b\n\ngo 1.21\ntoolchain go1.21.0\n",
+			expected: `module out
+
+go 1.22.3
+
+toolchain go1.22.5
+`,
+		},
+		"higher version of a shared requirement wins": {
+			base: "module a\n\ngo 1.22\n\nrequire (\n\texample.com/x v1.2.0\n\texample.com/y v1.0.0\n)\n",
+			other: "module b\n\ngo 1.22\n\nrequire (\n\texample.com/x v1.1.0\n\texample.com/y v1.3.0\n" +
+				"\texample.com/z v0.1.0\n)\n",
+			expected: `module out
+
+go 1.22
+
+require (
+	example.com/x v1.2.0
+	example.com/y v1.3.0
+	example.com/z v0.1.0
+)
+`,
+		},
+		"requirement is only indirect if it's indirect in both": {
+			base: "module a\n\ngo 1.22\n\nrequire (\n\texample.com/x v1.0.0 // indirect\n" +
+				"\texample.com/y v1.0.0 // indirect\n)\n",
+			other: "module b\n\ngo 1.22\n\nrequire (\n\texample.com/x v1.0.0\n" +
+				"\texample.com/y v1.0.0 // indirect\n)\n",
+			expected: `module out
+
+go 1.22
+
+require example.com/x v1.0.0
+
+require example.com/y v1.0.0 // indirect
+`,
+		},
+		"existing replacement wins": {
+			base: "module a\n\ngo 1.22\n\nreplace example.com/x => /src/x\n",
+			other: "module b\n\ngo 1.22\n\nreplace (\n\texample.com/x => /other/x\n" +
+				"\texample.com/y v1.0.0 => example.com/fork v1.0.1\n)\n",
+			expected: `module out
+
+go 1.22
+
+replace example.com/x => /src/x
+
+replace example.com/y v1.0.0 => example.com/fork v1.0.1
+`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			self := loadGoMod(t, tc.base, "")
+			self.Merge(loadGoMod(t, tc.other, ""))
+			if goMod, _ := writeGoMod(t, self, "out"); goMod != tc.expected {
+				t.Errorf("expected:\n%s\ngot:\n%s", tc.expected, goMod)
+			}
+		})
+	}
+}
+
+func TestGoModMergeSums(t *testing.T) {
+	self := loadGoMod(t, "module a\n\ngo 1.22\n", "example.com/x v1.0.0 h1:x=\nexample.com/y v1.0.0 h1:y=\n")
+	self.Merge(loadGoMod(t, "module b\n\ngo 1.22\n", "example.com/y v1.0.0 h1:y=\n\nexample.com/a v1.0.0 h1:a=\n"))
+
+	expected := "example.com/a v1.0.0 h1:a=\nexample.com/x v1.0.0 h1:x=\nexample.com/y v1.0.0 h1:y=\n"
+	if _, goSum := writeGoMod(t, self, "out"); goSum != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, goSum)
+	}
+}
+
+func TestGoModWrite(t *testing.T) {
+	src := loadGoMod(t, `module example.com/src
+
+go 1.22
+
+require example.com/x v1.0.0
+
+replace example.com/x => ./x
+`, "")
+
+	// Relative replacements are made absolute, so that they still work from the output directory
+	xDir := src.replaces[module.Version{Path: "example.com/x"}].Path
+	if !filepath.IsAbs(xDir) || filepath.Base(xDir) != "x" {
+		t.Fatalf("expected an absolute path to x, got %s", xDir)
+	}
+
+	for name, tc := range map[string]struct {
+		module   string
+		expected string
+	}{
+		"service module": {
+			module: "example.com/src/kompile/process",
+			expected: `module example.com/src/kompile/process
+
+go 1.22
+
+require (
+	example.com/src v0.0.0-00010101000000-000000000000
+	example.com/x v1.0.0
+)
+
+replace example.com/src => /src
+
+replace example.com/x => ` + xDir + `
+`,
+		},
+		"source module doesn't require itself": {
+			module: "example.com/src",
+			expected: `module example.com/src
+
+go 1.22
+
+require example.com/x v1.0.0
+
+replace example.com/x => ` + xDir + `
+`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			self := loadGoMod(t, "module example.com/src\n\ngo 1.22\n", "")
+			self.Merge(src)
+			self.AddLocal("example.com/src", "/src")
+			if goMod, _ := writeGoMod(t, self, tc.module); goMod != tc.expected {
+				t.Errorf("expected:\n%s\ngot:\n%s", tc.expected, goMod)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package util
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+const KomputilPackage = KompileModule + "/pkg/komputil"
+
+// Import is a package that generated code refers to; Name is only set when the package is imported under something
+// other than its own name
+type Import struct {
+	Name string
+	Path string
+}
+
+// AddImports adds each of the imports to file, unless it's already there
+func AddImports(fset *token.FileSet, file *ast.File, imports []Import) {
+	for _, imp := range imports {
+		astutil.AddNamedImport(fset, file, imp.Name, imp.Path)
+	}
+}
+
+// RemoveUnusedImports deletes any imports from file that aren't referenced anymore once we've rewritten it; info is
+// the type information for the original file, so any references that we added ourselves aren't counted here (those
+// are tracked separately and added with AddImports)
+func RemoveUnusedImports(fset *token.FileSet, file *ast.File, info *types.Info) {
+	used := map[*types.PkgName]bool{}
+	ast.Inspect(file, func(n ast.Node) bool {
+		if ident, ok := n.(*ast.Ident); ok {
+			if pkgName, ok := info.Uses[ident].(*types.PkgName); ok {
+				used[pkgName] = true
+			}
+		}
+		return true
+	})
+
+	for _, spec := range append([]*ast.ImportSpec{}, file.Imports...) {
+		pkgName := info.PkgNameOf(spec)
+		if pkgName == nil || used[pkgName] || spec.Name != nil && (spec.Name.Name == "_" || spec.Name.Name == ".") {
+			continue
+		}
+
+		name := ""
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+		astutil.DeleteNamedImport(fset, file, name, pkgName.Imported().Path())
+	}
+}
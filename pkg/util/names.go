@@ -0,0 +1,9 @@
+package util
+
+import "strings"
+
+// ResourceName is the name of the Kubernetes resources for the offloaded function called funcName; it has to be a
+// valid DNS label, which a Go identifier isn't necessarily
+func ResourceName(funcName string) string {
+	return strings.ReplaceAll(strings.ToLower(funcName), "_", "-")
+}
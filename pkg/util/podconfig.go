@@ -0,0 +1,28 @@
+package util
+
+// PodConfig is the per-function configuration for the pods that run an offloaded function's service, which comes from
+// //kompile: directives in the source (see kompiler.parseDirectives)
+type PodConfig struct {
+	// Resources are the container's resource requests, e.g. "cpu" -> "2"
+	Resources map[string]string
+
+	// Volumes are the host paths mounted into the container, and NodeSelector picks the nodes that the pods can run on
+	Volumes      []Volume
+	NodeSelector map[string]string
+}
+
+// Volume is a directory on the node that's mounted into the container at MountPath
+type Volume struct {
+	HostPath  string
+	MountPath string
+}
+
+// DefaultPodConfig is the configuration for functions that don't have any directives: they get the node's /data
+// directory, and they run on the kind worker nodes
+func DefaultPodConfig() *PodConfig {
+	return &PodConfig{
+		Resources:    map[string]string{},
+		Volumes:      []Volume{{HostPath: "/data", MountPath: "/data"}},
+		NodeSelector: map[string]string{"type": "kind-worker"},
+	}
+}